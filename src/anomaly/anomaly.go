@@ -0,0 +1,181 @@
+package anomaly
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/config"
+	"shurl/src/jobs"
+	"shurl/src/models"
+	"shurl/src/tracing"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// maxCatchUp bounds how many past hours a run checks after the detector was stopped
+const maxCatchUp = 24
+
+// Options configures the anomaly detector
+type Options struct {
+	// Interval is how often the hours completed since the last run are checked; zero disables detection
+	Interval time.Duration
+	Rule     jobs.AnomalyRule
+}
+
+// OptionsFromEnv reads the detector options from ANOMALY_CHECK_INTERVAL, ANOMALY_BASELINE,
+// ANOMALY_THRESHOLD and ANOMALY_MIN_VISITS
+func OptionsFromEnv() Options {
+	return Options{
+		Interval: config.GetEnvDuration("ANOMALY_CHECK_INTERVAL", 15*time.Minute),
+		Rule: jobs.AnomalyRule{
+			Baseline:  config.GetEnvDuration("ANOMALY_BASELINE", 7*24*time.Hour),
+			Threshold: config.GetEnvFloat("ANOMALY_THRESHOLD", 3),
+			MinVisits: config.GetEnvInt("ANOMALY_MIN_VISITS", 20),
+		},
+	}
+}
+
+// Stats is a snapshot of the detector state
+type Stats struct {
+	Enabled   bool       `json:"enabled"`
+	Running   bool       `json:"running"`
+	Runs      int64      `json:"runs"`
+	Failures  int64      `json:"failures"`
+	Anomalies int64      `json:"anomalies"`
+	LastHour  *time.Time `json:"last_hour,omitempty"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// Detector periodically checks the visits of each completed hour for spikes and drops.
+// A disabled detector does nothing.
+type Detector struct {
+	db     *sql.DB
+	opts   Options
+	logger *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	running   atomic.Bool
+	runs      atomic.Int64
+	failures  atomic.Int64
+	anomalies atomic.Int64
+
+	// mu guards the outcome of the last run
+	mu        sync.Mutex
+	lastHour  *time.Time
+	lastRunAt *time.Time
+	lastError string
+}
+
+// New creates a detector; call Start to run it
+func New(db *sql.DB, opts Options) *Detector {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Detector{db: db, opts: opts, logger: config.GetLogger(), ctx: ctx, cancel: cancel}
+}
+
+// Enabled reports whether a check interval is configured
+func (d *Detector) Enabled() bool {
+	return d.opts.Interval > 0
+}
+
+// Start checks the last completed hour immediately and then every Interval
+func (d *Detector) Start() {
+	if !d.Enabled() {
+		d.logger.Info("anomaly detection disabled, ANOMALY_CHECK_INTERVAL is 0")
+		return
+	}
+	d.wg.Add(1)
+	go d.loop()
+}
+
+// Close stops the detector, waiting for a check in progress
+func (d *Detector) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Stats returns a snapshot of the detector state
+func (d *Detector) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Stats{
+		Enabled:   d.Enabled(),
+		Running:   d.running.Load(),
+		Runs:      d.runs.Load(),
+		Failures:  d.failures.Load(),
+		Anomalies: d.anomalies.Load(),
+		LastHour:  d.lastHour,
+		LastRunAt: d.lastRunAt,
+		LastError: d.lastError,
+	}
+}
+
+func (d *Detector) loop() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	for {
+		d.run()
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// run checks every hour completed since the last checked one, or only the last completed hour on
+// the first run
+func (d *Detector) run() {
+	d.running.Store(true)
+	defer d.running.Store(false)
+
+	now := time.Now().UTC()
+	last := now.Truncate(time.Hour).Add(-time.Hour)
+	d.mu.Lock()
+	next := last
+	if d.lastHour != nil {
+		next = d.lastHour.Add(time.Hour)
+	}
+	d.mu.Unlock()
+	if last.Sub(next) >= maxCatchUp*time.Hour {
+		next = last.Add(-(maxCatchUp - 1) * time.Hour)
+	}
+
+	ctx, span := tracing.Start(d.ctx, "anomalies.run")
+	logger := tracing.Logger(ctx, d.logger)
+	var checked *time.Time
+	var err error
+	var found int
+	for hour := next; !hour.After(last); hour = hour.Add(time.Hour) {
+		var anomalies []models.Anomaly
+		anomalies, err = jobs.DetectAnomalies(ctx, d.db, logger, d.opts.Rule, hour)
+		found += len(anomalies)
+		if err != nil {
+			break
+		}
+		checked = &hour
+	}
+	span.SetAttributes(attribute.Int("anomalies", found))
+	tracing.End(span, err)
+	d.anomalies.Add(int64(found))
+	d.runs.Add(1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if checked != nil {
+		d.lastHour = checked
+	}
+	d.lastRunAt, d.lastError = &now, ""
+	if err != nil && d.ctx.Err() == nil {
+		d.failures.Add(1)
+		d.lastError = err.Error()
+		logger.Error("failed to detect link anomalies", zap.Error(err))
+	}
+}
@@ -0,0 +1,126 @@
+package botdetect
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"shurl/src/config"
+	"shurl/src/useragent"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Reasons a request was classified as automated
+const (
+	ReasonUserAgent     = "user_agent"
+	ReasonIP            = "ip"
+	ReasonHead          = "head_request"
+	ReasonMissingAccept = "missing_accept"
+)
+
+// Detector decides whether a request comes from a bot, crawler, monitor or scanner rather than a person
+type Detector struct {
+	networks []*net.IPNet
+}
+
+// New creates a detector that also treats requests from the given IP addresses and CIDR ranges as bots
+func New(ranges []string) (*Detector, error) {
+	d := &Detector{}
+	for _, r := range ranges {
+		r = strings.TrimSpace(r)
+		if r == "" || strings.HasPrefix(r, "#") {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", r)
+			}
+			if ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", r)
+		}
+		d.networks = append(d.networks, network)
+	}
+	return d, nil
+}
+
+// FromEnv creates a detector from the comma-separated BOT_IP_RANGES and the file named by
+// BOT_IP_RANGES_FILE, which lists one address or range per line. Invalid configuration is logged
+// and the user-agent and request heuristics keep working without the IP list.
+func FromEnv() *Detector {
+	logger := config.GetLogger()
+	ranges := strings.Split(os.Getenv("BOT_IP_RANGES"), ",")
+	if path := os.Getenv("BOT_IP_RANGES_FILE"); path != "" {
+		lines, err := readLines(path)
+		if err != nil {
+			logger.Error("failed to read bot IP ranges file", zap.String("path", path), zap.Error(err))
+		}
+		ranges = append(ranges, lines...)
+	}
+
+	d, err := New(ranges)
+	if err != nil {
+		logger.Error("invalid bot IP ranges, ignoring them", zap.Error(err))
+		return &Detector{}
+	}
+	return d
+}
+
+// Detect reports whether r, made from clientIP, is automated and why. Known bot user agents and
+// link-preview fetchers, listed IP ranges, HEAD requests and requests without an Accept header,
+// which every browser sends, all count as bots.
+func (d *Detector) Detect(r *http.Request, clientIP string) (bool, string) {
+	ua := r.UserAgent()
+	switch {
+	case useragent.IsUnfurler(ua), useragent.IsBot(ua):
+		return true, ReasonUserAgent
+	case d.matchIP(clientIP):
+		return true, ReasonIP
+	case r.Method == http.MethodHead:
+		return true, ReasonHead
+	case r.Header.Get("Accept") == "":
+		return true, ReasonMissingAccept
+	}
+	return false, ""
+}
+
+func (d *Detector) matchIP(clientIP string) bool {
+	if len(d.networks) == 0 {
+		return false
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range d.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
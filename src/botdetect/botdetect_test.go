@@ -0,0 +1,66 @@
+package botdetect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const chromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+func TestNew(t *testing.T) {
+	d, err := New([]string{"", "# monitoring", " 192.0.2.10 ", "198.51.100.0/24", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if len(d.networks) != 3 {
+		t.Errorf("New() parsed %d networks, want 3", len(d.networks))
+	}
+
+	for _, invalid := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if _, err := New([]string{invalid}); err == nil {
+			t.Errorf("New(%q) error = nil, want an error", invalid)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	d, err := New([]string{"192.0.2.10", "198.51.100.0/24"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		ua         string
+		accept     string
+		clientIP   string
+		wantBot    bool
+		wantReason string
+	}{
+		{"browser", http.MethodGet, chromeUA, "text/html", "203.0.113.5", false, ""},
+		{"crawler", http.MethodGet, "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", "*/*", "203.0.113.5", true, ReasonUserAgent},
+		{"link unfurler", http.MethodGet, "facebookexternalhit/1.1", "*/*", "203.0.113.5", true, ReasonUserAgent},
+		{"whatsapp fetcher", http.MethodGet, "WhatsApp/2.23.20.0 A", "*/*", "203.0.113.5", true, ReasonUserAgent},
+		{"whatsapp in-app browser", http.MethodGet, "Mozilla/5.0 (Linux; Android 13; SM-S911B Build/TP1A.220624.014; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/119.0.6045.163 Mobile Safari/537.36 WhatsApp/2.23.24.76", "text/html", "203.0.113.5", false, ""},
+		{"listed address", http.MethodGet, chromeUA, "text/html", "192.0.2.10", true, ReasonIP},
+		{"listed range", http.MethodGet, chromeUA, "text/html", "198.51.100.77", true, ReasonIP},
+		{"head request", http.MethodHead, chromeUA, "text/html", "203.0.113.5", true, ReasonHead},
+		{"missing accept", http.MethodGet, chromeUA, "", "203.0.113.5", true, ReasonMissingAccept},
+		{"invalid client ip", http.MethodGet, chromeUA, "text/html", "unknown", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/abc", nil)
+			r.Header.Set("User-Agent", tt.ua)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			bot, reason := d.Detect(r, tt.clientIP)
+			if bot != tt.wantBot || reason != tt.wantReason {
+				t.Errorf("Detect() = %v, %q, want %v, %q", bot, reason, tt.wantBot, tt.wantReason)
+			}
+		})
+	}
+}
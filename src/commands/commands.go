@@ -0,0 +1,258 @@
+// Package commands implements the maintenance subcommands of the shurl binary, run as
+// `shurl <command> [flags]` instead of starting the HTTP server.
+package commands
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"shurl/src/anomaly"
+	"shurl/src/config"
+	"shurl/src/db"
+	"shurl/src/export"
+	"shurl/src/jobs"
+	"shurl/src/privacy"
+	"shurl/src/referrer"
+	"shurl/src/retention"
+
+	"go.uber.org/zap"
+)
+
+// command runs with a database connection and the arguments following its name
+type command struct {
+	usage string
+	run   func(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error
+}
+
+var registry = map[string]command{
+	"anonymize-ips": {
+		usage: "convert the stored IP addresses of past visits to a more private mode",
+		run:   anonymizeIPs,
+	},
+	"export-visits": {
+		usage: "write raw visits as CSV or NDJSON to a file or standard output",
+		run:   exportVisits,
+	},
+	"backfill-user-agents": {
+		usage: "parse the user agent of visits recorded before user-agent parsing existed",
+		run:   backfillUserAgents,
+	},
+	"backfill-referrers": {
+		usage: "classify the referrer of visits recorded before referrer classification existed",
+		run:   backfillReferrers,
+	},
+	"rollup-visits": {
+		usage: "roll visits older than the retention period into daily counts and delete them",
+		run:   rollupVisits,
+	},
+	"detect-anomalies": {
+		usage: "flag spikes and drops in the hourly visits of links over the last hours",
+		run:   detectAnomalies,
+	},
+	"backfill-visitor-sketches": {
+		usage: "rebuild the daily unique visitor sketches of past days from stored visitor hashes",
+		run:   backfillVisitorSketches,
+	},
+}
+
+// Run executes the subcommand named by args[0] and returns the process exit code.
+// The command's context is cancelled on SIGINT or SIGTERM.
+func Run(args []string) int {
+	logger := config.GetLogger()
+	cmd, ok := registry[args[0]]
+	if !ok {
+		usage()
+		return 2
+	}
+
+	conn, err := db.Connect()
+	if err != nil {
+		logger.Error("failed to connect to database", zap.Error(err))
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := cmd.run(ctx, conn, logger, args[1:]); err != nil {
+		logger.Error("command failed", zap.String("command", args[0]), zap.Error(err))
+		return 1
+	}
+	return 0
+}
+
+func usage() {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: shurl [command] [flags]")
+	fmt.Fprintln(os.Stderr, "Runs the server when no command is given. Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", name, registry[name].usage)
+	}
+}
+
+func backfillUserAgents(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("backfill-user-agents", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 1000, "number of visits updated per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("batch-size must be positive")
+	}
+
+	total, err := jobs.BackfillUserAgents(ctx, db, logger, *batchSize)
+	logger.Info("user agent backfill finished", zap.Int("updated", total))
+	return err
+}
+
+func backfillReferrers(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("backfill-referrers", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 1000, "number of visits updated per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("batch-size must be positive")
+	}
+
+	total, err := jobs.BackfillReferrers(ctx, db, logger, referrer.ClassifierFromEnv(), *batchSize)
+	logger.Info("referrer backfill finished", zap.Int("updated", total))
+	return err
+}
+
+func backfillVisitorSketches(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	days, err := jobs.BackfillVisitorSketches(ctx, db, logger)
+	logger.Info("visitor sketch backfill finished", zap.Int("days", days))
+	return err
+}
+
+func anonymizeIPs(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	opts, err := privacy.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("anonymize-ips", flag.ContinueOnError)
+	mode := fs.String("mode", string(opts.Mode), "privacy mode to convert addresses to: truncate, hash or none")
+	batchSize := fs.Int("batch-size", 1000, "number of visits updated per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("batch-size must be positive")
+	}
+	if opts.Mode, err = privacy.ParseMode(*mode); err != nil {
+		return err
+	}
+	if opts.Mode == privacy.ModeHash && len(opts.HashKey) == 0 {
+		return fmt.Errorf("IP_HASH_KEY is required with the hash privacy mode")
+	}
+
+	total, err := jobs.AnonymizeIPs(ctx, db, logger, opts, *batchSize)
+	logger.Info("IP anonymization finished", zap.String("mode", string(opts.Mode)), zap.Int("updated", total))
+	return err
+}
+
+func rollupVisits(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	opts := retention.OptionsFromEnv()
+	fs := flag.NewFlagSet("rollup-visits", flag.ContinueOnError)
+	fs.IntVar(&opts.Days, "retention-days", opts.Days, "days of raw visits to keep, counting today")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.Days < 1 {
+		return fmt.Errorf("retention-days must be positive, set it or VISIT_RETENTION_DAYS")
+	}
+
+	cutoff := opts.Cutoff(time.Now())
+	days, err := jobs.RollupVisits(ctx, db, logger, cutoff)
+	logger.Info("visit rollup finished", zap.Time("cutoff", cutoff), zap.Int("days", days))
+	return err
+}
+
+func detectAnomalies(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	opts := anomaly.OptionsFromEnv()
+	fs := flag.NewFlagSet("detect-anomalies", flag.ContinueOnError)
+	hours := fs.Int("hours", 24, "number of completed hours to check, ending with the last one")
+	fs.DurationVar(&opts.Rule.Baseline, "baseline", opts.Rule.Baseline, "period before each hour its visits are compared with")
+	fs.Float64Var(&opts.Rule.Threshold, "threshold", opts.Rule.Threshold, "standard deviations from the baseline an hour must be")
+	fs.IntVar(&opts.Rule.MinVisits, "min-visits", opts.Rule.MinVisits, "fewest visits of a spike and lowest baseline of a drop")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *hours < 1 {
+		return fmt.Errorf("hours must be positive")
+	}
+
+	last := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	total := 0
+	for hour := last.Add(-time.Duration(*hours-1) * time.Hour); !hour.After(last); hour = hour.Add(time.Hour) {
+		anomalies, err := jobs.DetectAnomalies(ctx, db, logger, opts.Rule, hour)
+		total += len(anomalies)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Info("anomaly detection finished", zap.Int("hours", *hours), zap.Int("anomalies", total))
+	return nil
+}
+
+func exportVisits(ctx context.Context, db *sql.DB, logger *zap.Logger, args []string) error {
+	fs := flag.NewFlagSet("export-visits", flag.ContinueOnError)
+	formatName := fs.String("format", string(export.FormatCSV), "file format: csv or ndjson")
+	linkID := fs.Int("link", 0, "export only the visits of this link ID")
+	fromValue := fs.String("from", "", "export visits from this RFC3339 time or YYYY-MM-DD date")
+	toValue := fs.String("to", "", "export visits before this RFC3339 time or YYYY-MM-DD date")
+	includeBots := fs.Bool("include-bots", false, "export bot visits too")
+	output := fs.String("output", "", "file to write, standard output when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	q := export.Query{IncludeBots: *includeBots}
+	if *linkID != 0 {
+		q.LinkID = linkID
+	}
+	if q.From, err = export.ParseTime(*fromValue); err != nil {
+		return err
+	}
+	if q.To, err = export.ParseTime(*toValue); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" {
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		w = file
+	}
+
+	n, err := export.Write(ctx, db, w, format, q, nil)
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	logger.Info("visit export finished", zap.String("format", string(format)), zap.Int("rows", n))
+	return err
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// AppLinks holds the app identities published in the .well-known association files
+type AppLinks struct {
+	// AppleAppIDs are "<team id>.<bundle id>" identifiers allowed to open universal links
+	AppleAppIDs []string
+	// ApplePaths are the path patterns the iOS apps handle
+	ApplePaths []string
+	// AndroidPackage is the application ID allowed to open Android app links
+	AndroidPackage string
+	// AndroidFingerprints are the SHA-256 fingerprints of the Android signing certificates
+	AndroidFingerprints []string
+}
+
+// GetAppLinks reads the app link configuration from the environment
+func GetAppLinks() AppLinks {
+	paths := splitList(os.Getenv("APPLE_APP_PATHS"))
+	if len(paths) == 0 {
+		paths = []string{"*"}
+	}
+	return AppLinks{
+		AppleAppIDs:         splitList(os.Getenv("APPLE_APP_IDS")),
+		ApplePaths:          paths,
+		AndroidPackage:      strings.TrimSpace(os.Getenv("ANDROID_APP_PACKAGE")),
+		AndroidFingerprints: splitList(os.Getenv("ANDROID_APP_SHA256_FINGERPRINTS")),
+	}
+}
+
+// splitList splits a comma-separated value, dropping blank entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
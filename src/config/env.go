@@ -0,0 +1,34 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// GetEnvInt reads an integer environment variable, returning fallback when it is unset or invalid
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// GetEnvDuration reads a duration such as "500ms" or "2s", returning fallback when it is unset or invalid
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// GetEnvFloat reads a floating point environment variable, returning fallback when it is unset or invalid
+func GetEnvFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -1,15 +1,71 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"os"
+
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 var Logger *zap.Logger
 
 func init() {
-	Logger, _ = zap.NewProduction()
+	var err error
+	Logger, err = NewLogger()
+	if err != nil {
+		// Logging has to work even when misconfigured, so fall back to JSON at info level on stderr
+		encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+		Logger = zap.New(zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), zap.InfoLevel), zap.AddCaller())
+		Logger.Error("invalid logging configuration, using the defaults", zap.Error(err))
+	}
 }
 
 func GetLogger() *zap.Logger {
 	return Logger
 }
+
+// NewLogger builds the application logger from LOG_LEVEL (debug, info, warn or error), LOG_FORMAT
+// (json or console) and the sampling settings: each second, the first LOG_SAMPLING_INITIAL entries
+// with the same level and message are written and then every LOG_SAMPLING_THEREAFTER-th. An initial
+// count of 0 disables sampling.
+func NewLogger() (*zap.Logger, error) {
+	cfg := zap.NewProductionConfig()
+	if err := cfg.Level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "json":
+	case "console":
+		cfg.Encoding = "console"
+		cfg.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q, expected json or console", format)
+	}
+
+	cfg.Sampling = nil
+	if initial := GetEnvInt("LOG_SAMPLING_INITIAL", 100); initial > 0 {
+		cfg.Sampling = &zap.SamplingConfig{
+			Initial:    initial,
+			Thereafter: max(GetEnvInt("LOG_SAMPLING_THEREAFTER", 100), 1),
+		}
+	}
+	return cfg.Build()
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying logger, typically one annotated for a single request
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger carried by ctx, or the application logger when there is none
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return Logger
+}
@@ -1,19 +1,34 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"os"
 	"shurl/src/config"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// Connect opens the connection pool. Queries are traced as children of the span in their context;
+// queries made without one, such as those of the pool itself, are not traced.
 func Connect() (*sql.DB, error) {
 	logger := config.GetLogger()
 
-	db, err := sql.Open("postgres", os.Getenv("POSTGRES_URI"))
+	db, err := otelsql.Open("postgres", os.Getenv("POSTGRES_URI"),
+		otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid()
+			},
+		}))
 	if err != nil {
 		logger.Error("Failed to connect to database", zap.Error(err))
 		return nil, err
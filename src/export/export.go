@@ -0,0 +1,340 @@
+// Package export writes raw visits as CSV or newline-delimited JSON. Rows are read through a
+// server-side cursor and written as they arrive, so an export of any size uses constant memory.
+package export
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is an export file format
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+// ParseFormat validates a format name
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(strings.ToLower(s)); format {
+	case FormatCSV, FormatNDJSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("format must be csv or ndjson")
+}
+
+// ContentType is the MIME type of the format
+func (f Format) ContentType() string {
+	if f == FormatNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// fetchSize is the number of rows fetched from the cursor at a time
+const fetchSize = 1000
+
+// kind is the type of an exported column
+type kind int
+
+const (
+	kindInt kind = iota
+	kindString
+	kindBool
+	kindTime
+)
+
+// column is one exported field and the expression selecting it from visits joined to links
+type column struct {
+	name string
+	expr string
+	kind kind
+}
+
+// columns are the exported fields, in order. Their names and types never change between rows, and
+// values a visit does not have are empty in CSV and null in NDJSON, so files load into typed tables.
+var columns = []column{
+	{"id", "v.id", kindInt},
+	{"link_id", "v.link_id", kindInt},
+	{"code", "l.code", kindString},
+	{"created_at", "v.created_at", kindTime},
+	{"source", "v.source", kindString},
+	{"is_bot", "v.is_bot", kindBool},
+	{"anonymous", "v.anonymous", kindBool},
+	{"ip_address", "v.ip_address", kindString},
+	{"ip_mode", "v.ip_mode", kindString},
+	{"user_agent", "v.user_agent", kindString},
+	{"browser", "v.browser", kindString},
+	{"browser_version", "v.browser_version", kindString},
+	{"os", "v.os", kindString},
+	{"os_version", "v.os_version", kindString},
+	{"device_type", "v.device_type", kindString},
+	{"bot_name", "v.bot_name", kindString},
+	{"country", "v.country", kindString},
+	{"region", "v.region", kindString},
+	{"city", "v.city", kindString},
+	{"asn", "v.asn", kindInt},
+	{"as_org", "v.as_org", kindString},
+	{"referrer", "v.referrer", kindString},
+	{"referrer_host", "v.referrer_host", kindString},
+	{"referrer_class", "v.referrer_class", kindString},
+	{"utm_source", "v.utm_source", kindString},
+	{"utm_medium", "v.utm_medium", kindString},
+	{"utm_campaign", "v.utm_campaign", kindString},
+	{"utm_term", "v.utm_term", kindString},
+	{"utm_content", "v.utm_content", kindString},
+}
+
+// Query selects the visits to export
+type Query struct {
+	// LinkID limits the export to one link; nil exports every link
+	LinkID *int
+	// From and To bound created_at, inclusive and exclusive; nil leaves that side open
+	From *time.Time
+	To   *time.Time
+	// IncludeBots exports bot visits too
+	IncludeBots bool
+}
+
+// ParseTime parses an RFC3339 timestamp or a YYYY-MM-DD date, as accepted by the stats endpoints.
+// Visit timestamps are stored in UTC, so the result is converted to UTC.
+func ParseTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not an RFC3339 timestamp or a YYYY-MM-DD date", value)
+}
+
+// rowWriter encodes one format
+type rowWriter interface {
+	header() error
+	row(values []any) error
+	flush() error
+}
+
+// Write exports the visits selected by q to w in format, oldest first, and returns the number of
+// visits written. The rows come from one read-only snapshot, so visits recorded during a long export
+// are not included. After each batch of rows w is flushed, and so is flush when it is not nil,
+// letting HTTP clients receive the file progressively.
+func Write(ctx context.Context, db *sql.DB, w io.Writer, format Format, q Query, flush func()) (int, error) {
+	buf := bufio.NewWriter(w)
+	var out rowWriter
+	switch format {
+	case FormatCSV:
+		out = &csvWriter{w: csv.NewWriter(buf)}
+	case FormatNDJSON:
+		out = &ndjsonWriter{w: buf}
+	default:
+		return 0, fmt.Errorf("unsupported export format %q", format)
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	exprs := make([]string, len(columns))
+	for i, col := range columns {
+		exprs[i] = col.expr
+	}
+	_, err = tx.ExecContext(ctx, `DECLARE visit_export NO SCROLL CURSOR FOR
+		SELECT `+strings.Join(exprs, ", ")+`
+		FROM visits v JOIN links l ON l.id = v.link_id
+		WHERE ($1::int IS NULL OR v.link_id = $1)
+			AND ($2::timestamp IS NULL OR v.created_at >= $2)
+			AND ($3::timestamp IS NULL OR v.created_at < $3)
+			AND ($4::boolean OR NOT v.is_bot)
+		ORDER BY v.created_at, v.id`, q.LinkID, q.From, q.To, q.IncludeBots)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := out.header(); err != nil {
+		return 0, err
+	}
+	total := 0
+	for {
+		n, err := fetch(ctx, tx, out)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if err := out.flush(); err != nil {
+			return total, err
+		}
+		if err := buf.Flush(); err != nil {
+			return total, err
+		}
+		if flush != nil {
+			flush()
+		}
+		if n < fetchSize {
+			return total, tx.Commit()
+		}
+	}
+}
+
+// fetch writes the next batch of cursor rows and returns how many there were
+func fetch(ctx context.Context, tx *sql.Tx, out rowWriter) (int, error) {
+	rows, err := tx.QueryContext(ctx, `FETCH `+strconv.Itoa(fetchSize)+` FROM visit_export`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	values := make([]any, len(columns))
+	for i, col := range columns {
+		switch col.kind {
+		case kindInt:
+			values[i] = new(sql.NullInt64)
+		case kindBool:
+			values[i] = new(sql.NullBool)
+		case kindTime:
+			values[i] = new(sql.NullTime)
+		default:
+			values[i] = new(sql.NullString)
+		}
+	}
+
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return n, err
+		}
+		if err := out.row(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// csvWriter writes a header line and one line per visit; null values are empty and text that
+// would be read as a formula is escaped
+type csvWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func (c *csvWriter) header() error {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.name
+	}
+	c.record = make([]string, len(columns))
+	return c.w.Write(names)
+}
+
+func (c *csvWriter) row(values []any) error {
+	for i, value := range values {
+		c.record[i] = ""
+		switch v := value.(type) {
+		case *sql.NullInt64:
+			if v.Valid {
+				c.record[i] = strconv.FormatInt(v.Int64, 10)
+			}
+		case *sql.NullBool:
+			if v.Valid {
+				c.record[i] = strconv.FormatBool(v.Bool)
+			}
+		case *sql.NullTime:
+			if v.Valid {
+				c.record[i] = v.Time.UTC().Format(time.RFC3339Nano)
+			}
+		case *sql.NullString:
+			if v.Valid {
+				c.record[i] = escapeFormula(v.String)
+			}
+		}
+	}
+	return c.w.Write(c.record)
+}
+
+// escapeFormula prefixes text that a spreadsheet would run as a formula with a quote, as referrers,
+// user agents and campaign parameters come from visitors. NDJSON is left raw.
+func escapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// ndjsonWriter writes one JSON object per line with the keys in column order
+type ndjsonWriter struct {
+	w    *bufio.Writer
+	keys [][]byte
+}
+
+func (n *ndjsonWriter) header() error {
+	n.keys = make([][]byte, len(columns))
+	for i, col := range columns {
+		key, err := json.Marshal(col.name)
+		if err != nil {
+			return err
+		}
+		n.keys[i] = append(key, ':')
+	}
+	return nil
+}
+
+func (n *ndjsonWriter) row(values []any) error {
+	n.w.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			n.w.WriteByte(',')
+		}
+		n.w.Write(n.keys[i])
+
+		var encoded any
+		switch v := value.(type) {
+		case *sql.NullInt64:
+			if v.Valid {
+				encoded = v.Int64
+			}
+		case *sql.NullBool:
+			if v.Valid {
+				encoded = v.Bool
+			}
+		case *sql.NullTime:
+			if v.Valid {
+				encoded = v.Time.UTC().Format(time.RFC3339Nano)
+			}
+		case *sql.NullString:
+			if v.Valid {
+				encoded = v.String
+			}
+		}
+		data, err := json.Marshal(encoded)
+		if err != nil {
+			return err
+		}
+		n.w.Write(data)
+	}
+	n.w.WriteByte('}')
+	return n.w.WriteByte('\n')
+}
+
+func (n *ndjsonWriter) flush() error {
+	return nil
+}
@@ -0,0 +1,263 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"shurl/src/config"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// Location is what the databases know about an IP address. Fields the databases do not cover are empty.
+type Location struct {
+	Country string
+	Region  string
+	City    string
+	ASN     uint
+	ASOrg   string
+}
+
+// record decodes the fields shared by GeoLite2/GeoIP2 City, Country and ASN databases,
+// and by combined databases that carry both
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Options configures the enricher
+type Options struct {
+	// Path is the MaxMind-format city or country database; empty disables enrichment
+	Path string
+	// ASNPath is an optional separate ASN database, as MaxMind ships ASN data on its own
+	ASNPath string
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration
+}
+
+// OptionsFromEnv reads the enricher options from the environment
+func OptionsFromEnv() Options {
+	return Options{
+		Path:           os.Getenv("GEOIP_DB_PATH"),
+		ASNPath:        os.Getenv("GEOIP_ASN_DB_PATH"),
+		ReloadInterval: config.GetEnvDuration("GEOIP_RELOAD_INTERVAL", time.Minute),
+	}
+}
+
+// Stats is a snapshot of the enricher state
+type Stats struct {
+	Enabled     bool       `json:"enabled"`
+	Loaded      bool       `json:"loaded"`
+	BuildTime   *time.Time `json:"build_time,omitempty"`
+	Reloads     int64      `json:"reloads"`
+	LoadErrors  int64      `json:"load_errors"`
+	Lookups     int64      `json:"lookups"`
+	LookupFails int64      `json:"lookup_failures"`
+}
+
+// fileState identifies a version of a database file
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// database is one loaded .mmdb file together with the file state it was read from
+type database struct {
+	path   string
+	reader *maxminddb.Reader
+	state  fileState
+}
+
+// Enricher resolves IP addresses to locations from local MaxMind-format databases and reloads the
+// files when they change on disk. The zero configuration is valid: lookups then return an empty Location.
+type Enricher struct {
+	opts   Options
+	logger *zap.Logger
+
+	city atomic.Pointer[database]
+	asn  atomic.Pointer[database]
+
+	// failed remembers the file state of the last failed load per path, so a broken file is
+	// reported once rather than on every check. Only the loading goroutine touches it.
+	failed map[string]fileState
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	reloads     atomic.Int64
+	loadErrors  atomic.Int64
+	lookups     atomic.Int64
+	lookupFails atomic.Int64
+}
+
+// New creates an enricher and loads the configured databases. A database that fails to load is
+// logged and retried on the next reload check, so a missing file never prevents startup.
+func New(opts Options) *Enricher {
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = time.Minute
+	}
+	e := &Enricher{
+		opts:   opts,
+		logger: config.GetLogger(),
+		failed: make(map[string]fileState),
+		stop:   make(chan struct{}),
+	}
+	if !e.Enabled() {
+		e.logger.Info("geoip enrichment disabled, GEOIP_DB_PATH is not set")
+		return e
+	}
+	e.reload(&e.city, opts.Path)
+	e.reload(&e.asn, opts.ASNPath)
+	return e
+}
+
+// Enabled reports whether a database is configured
+func (e *Enricher) Enabled() bool {
+	return e.opts.Path != "" || e.opts.ASNPath != ""
+}
+
+// Start watches the database files for changes
+func (e *Enricher) Start() {
+	if !e.Enabled() {
+		return
+	}
+	e.wg.Add(1)
+	go e.watch()
+}
+
+// Close stops watching the database files
+func (e *Enricher) Close() {
+	if !e.Enabled() {
+		return
+	}
+	close(e.stop)
+	e.wg.Wait()
+}
+
+// Lookup returns the location of ip. Unparseable addresses, addresses missing from the databases
+// and a disabled enricher all yield an empty Location.
+func (e *Enricher) Lookup(ip string) Location {
+	var loc Location
+	if !e.Enabled() {
+		return loc
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return loc
+	}
+
+	e.lookups.Add(1)
+	for _, db := range []*database{e.city.Load(), e.asn.Load()} {
+		if db == nil {
+			continue
+		}
+		var rec record
+		if err := db.reader.Lookup(addr, &rec); err != nil {
+			e.lookupFails.Add(1)
+			e.logger.Debug("geoip lookup failed", zap.String("path", db.path), zap.Error(err))
+			continue
+		}
+		if rec.Country.ISOCode != "" {
+			loc.Country = rec.Country.ISOCode
+		}
+		if len(rec.Subdivisions) > 0 && rec.Subdivisions[0].Names["en"] != "" {
+			loc.Region = rec.Subdivisions[0].Names["en"]
+		}
+		if rec.City.Names["en"] != "" {
+			loc.City = rec.City.Names["en"]
+		}
+		if rec.ASN != 0 {
+			loc.ASN, loc.ASOrg = rec.ASN, rec.ASOrg
+		}
+	}
+	return loc
+}
+
+// Stats returns a snapshot of the enricher state
+func (e *Enricher) Stats() Stats {
+	stats := Stats{
+		Enabled:     e.Enabled(),
+		Reloads:     e.reloads.Load(),
+		LoadErrors:  e.loadErrors.Load(),
+		Lookups:     e.lookups.Load(),
+		LookupFails: e.lookupFails.Load(),
+	}
+	db := e.city.Load()
+	if db == nil {
+		db = e.asn.Load()
+	}
+	if db != nil {
+		built := time.Unix(int64(db.reader.Metadata.BuildEpoch), 0).UTC()
+		stats.Loaded, stats.BuildTime = true, &built
+	}
+	return stats
+}
+
+func (e *Enricher) watch() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.opts.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			e.reload(&e.city, e.opts.Path)
+			e.reload(&e.asn, e.opts.ASNPath)
+		}
+	}
+}
+
+// reload loads path into slot when the file is new or its modification time or size changed.
+// The file is read into memory rather than mapped, so a replaced reader can simply be dropped
+// while lookups on it are still in flight.
+func (e *Enricher) reload(slot *atomic.Pointer[database], path string) {
+	if path == "" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if _, reported := e.failed[path]; !reported {
+			e.loadErrors.Add(1)
+			e.logger.Warn("geoip database unavailable", zap.String("path", path), zap.Error(err))
+		}
+		e.failed[path] = fileState{}
+		return
+	}
+	state := fileState{modTime: info.ModTime(), size: info.Size()}
+	current := slot.Load()
+	if (current != nil && current.state == state) || e.failed[path] == state {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var reader *maxminddb.Reader
+		if reader, err = maxminddb.FromBytes(data); err == nil {
+			slot.Store(&database{path: path, reader: reader, state: state})
+			delete(e.failed, path)
+			if current != nil {
+				e.reloads.Add(1)
+			}
+			e.logger.Info("geoip database loaded", zap.String("path", path),
+				zap.String("type", reader.Metadata.DatabaseType),
+				zap.Time("buildTime", time.Unix(int64(reader.Metadata.BuildEpoch), 0)))
+			return
+		}
+	}
+	e.failed[path] = state
+	e.loadErrors.Add(1)
+	e.logger.Error("failed to load geoip database", zap.String("path", path), zap.Error(err))
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"shurl/src/config"
+	"shurl/src/models"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// HandleAppleAppSiteAssociation serves the apple-app-site-association file that lets the configured
+// iOS apps open short links as universal links
+func HandleAppleAppSiteAssociation(appLinks config.AppLinks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(appLinks.AppleAppIDs) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "no iOS apps configured"})
+			return
+		}
+
+		components := make([]gin.H, 0, len(appLinks.ApplePaths))
+		for _, path := range appLinks.ApplePaths {
+			components = append(components, gin.H{"/": path})
+		}
+		// iOS 13+ reads appIDs/components, older versions read one appID/paths entry per app
+		details := []gin.H{{"appIDs": appLinks.AppleAppIDs, "components": components}}
+		for _, appID := range appLinks.AppleAppIDs {
+			details = append(details, gin.H{"appID": appID, "paths": appLinks.ApplePaths})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"applinks": gin.H{
+				"apps":    []string{},
+				"details": details,
+			},
+		})
+	}
+}
+
+// HandleAssetLinks serves the Digital Asset Links statement that lets the configured
+// Android app open short links as app links
+func HandleAssetLinks(appLinks config.AppLinks) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if appLinks.AndroidPackage == "" || len(appLinks.AndroidFingerprints) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "no Android app configured"})
+			return
+		}
+
+		c.JSON(http.StatusOK, []gin.H{{
+			"relation": []string{"delegate_permission/common.handle_all_urls"},
+			"target": gin.H{
+				"namespace":                "android_app",
+				"package_name":             appLinks.AndroidPackage,
+				"sha256_cert_fingerprints": appLinks.AndroidFingerprints,
+			},
+		}})
+	}
+}
+
+// renderAppBounce serves a page that fires the link's pixels, tries to open the native app and
+// falls back to the store listing, or to the web destination when no store URL is set
+func renderAppBounce(c *gin.Context, appURL, storeURL, webURL string, pixels pixelPage) {
+	logger := requestLogger(c)
+	tmpl, err := template.ParseFiles("src/templates/app_bounce.html", "src/templates/pixels.html")
+	if err != nil {
+		logger.Error("failed to parse app_bounce template", zap.Error(err))
+		c.Redirect(http.StatusTemporaryRedirect, webURL)
+		return
+	}
+
+	// Links saved before app URLs were restricted to safe schemes are checked again here
+	if !models.IsAppURL(appURL) {
+		logger.Warn("refusing app URL with an unsafe scheme")
+		c.Redirect(http.StatusTemporaryRedirect, webURL)
+		return
+	}
+	fallbackURL := storeURL
+	if fallbackURL == "" || !models.IsAppURL(fallbackURL) {
+		fallbackURL = webURL
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	err = tmpl.ExecuteTemplate(c.Writer, "app_bounce", gin.H{
+		// App URLs use custom schemes that html/template would otherwise filter out of
+		// attributes; both have been checked with IsAppURL above
+		"AppURL":      template.URL(appURL),
+		"FallbackURL": template.URL(fallbackURL),
+		"WebURL":      webURL,
+		"Pixels":      pixels,
+	})
+	if err != nil {
+		logger.Error("failed to execute app_bounce template", zap.Error(err))
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// breakdownDimensions maps the dimensions accepted by HandleLinkBreakdown and HandleBreakdown to their visits column
+var breakdownDimensions = map[string]string{
+	"browser":     "browser",
+	"os":          "os",
+	"device_type": "device_type",
+	"bot_name":    "bot_name",
+	"country":     "country",
+	"region":      "region",
+	"city":        "city",
+	// referrer is the referring host, source the class it was attributed to
+	"referrer": "referrer_host",
+	"source":   "referrer_class",
+}
+
+// nonNullDimensions are the columns whose null rows are left out of breakdowns: only bots have a
+// bot name and direct visits have no referrer host
+var nonNullDimensions = map[string]bool{
+	"bot_name":      true,
+	"referrer_host": true,
+}
+
+// rolledUpDimensions are the columns kept in visit_daily_rollups. Breakdowns by the other columns
+// only cover visits within the retention period.
+var rolledUpDimensions = map[string]bool{
+	"country":        true,
+	"device_type":    true,
+	"referrer_class": true,
+}
+
+const (
+	defaultBreakdownLimit = 10
+	maxBreakdownLimit     = 100
+)
+
+// BreakdownEntry is the number of visits sharing one value of a dimension
+type BreakdownEntry struct {
+	Value  string `json:"value"`
+	Visits int    `json:"visits"`
+}
+
+// parseBreakdownLimit reads the limit query parameter, writing a 400 response when it is invalid
+func parseBreakdownLimit(c *gin.Context) (int, bool) {
+	raw := c.Query("limit")
+	if raw == "" {
+		return defaultBreakdownLimit, true
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxBreakdownLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "limit must be between 1 and " + strconv.Itoa(maxBreakdownLimit)})
+		return 0, false
+	}
+	return limit, true
+}
+
+// HandleLinkBreakdown returns the top values of a user-agent, location or referrer dimension for a
+// link's visits. Visits without a value for the dimension are grouped under "Unknown".
+func HandleLinkBreakdown(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		column, ok := breakdownDimensions[c.Param("dimension")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "dimension must be one of browser, os, device_type, bot_name, country, region, city, referrer, source"})
+			return
+		}
+		writeBreakdown(c, db, column, true)
+	}
+}
+
+// HandleBreakdown returns the top values of a dimension across the visits of all links
+func HandleBreakdown(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		column, ok := breakdownDimensions[c.Param("dimension")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "dimension must be one of browser, os, device_type, bot_name, country, region, city, referrer, source"})
+			return
+		}
+		writeBreakdown(c, db, column, false)
+	}
+}
+
+// HandleLinkTopReferrers returns the hosts that referred the most visits to a link
+func HandleLinkTopReferrers(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeBreakdown(c, db, "referrer_host", true)
+	}
+}
+
+// HandleLinkTopSources returns a link's visits per source class (direct, search, social, email, internal, other)
+func HandleLinkTopSources(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeBreakdown(c, db, "referrer_class", true)
+	}
+}
+
+// HandleTopReferrers returns the hosts that referred the most visits across all links
+func HandleTopReferrers(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeBreakdown(c, db, "referrer_host", false)
+	}
+}
+
+// HandleTopSources returns the visits across all links per source class
+func HandleTopSources(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeBreakdown(c, db, "referrer_class", false)
+	}
+}
+
+// writeBreakdown responds with the breakdown of column over the requested range and limit,
+// for the link named by the :id parameter when perLink is set or else across all links
+func writeBreakdown(c *gin.Context, db *sql.DB, column string, perLink bool) {
+	limit, ok := parseBreakdownLimit(c)
+	if !ok {
+		return
+	}
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	includeBots, ok := parseIncludeBots(c)
+	if !ok {
+		return
+	}
+	var linkID *int
+	if perLink {
+		id, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+		linkID = &id
+	}
+
+	entries, err := queryBreakdown(c.Request.Context(), db, linkID, column, from, to, includeBots, limit)
+	if err != nil {
+		requestLogger(c).Error("failed to query visit breakdown", zap.Any("id", linkID), zap.String("dimension", column), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query visit breakdown"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "visit breakdown fetched successfully", "data": entries})
+}
+
+// queryBreakdown counts visits per value of column, which must come from breakdownDimensions,
+// for one link or across all links when linkID is nil. Bot visits are left out unless includeBots
+// is set or the breakdown is by bot name. Rolled-up days are included for rolledUpDimensions.
+func queryBreakdown(ctx context.Context, db *sql.DB, linkID *int, column string, from, to *time.Time, includeBots bool, limit int) ([]BreakdownEntry, error) {
+	filter := ""
+	if nonNullDimensions[column] {
+		filter = " AND " + column + " IS NOT NULL"
+	}
+	if column == "bot_name" {
+		includeBots = true
+	}
+	rolledUp := ""
+	if rolledUpDimensions[column] {
+		// Rollups store unknown values as ''
+		rolledUp = `
+			UNION ALL
+			SELECT NULLIF(` + column + `, '') AS value, visits
+			FROM visit_daily_rollups
+			WHERE ($1::int IS NULL OR link_id = $1)
+				AND ($2::timestamp IS NULL OR day >= $2::date)
+				AND ($3::timestamp IS NULL OR day < $3::timestamp)
+				AND ($4::boolean OR NOT is_bot)`
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT COALESCE(value, 'Unknown') AS value, SUM(visits)
+		FROM (
+			SELECT `+column+` AS value, 1 AS visits
+			FROM visits
+			WHERE ($1::int IS NULL OR link_id = $1)
+				AND ($2::timestamp IS NULL OR created_at >= $2)
+				AND ($3::timestamp IS NULL OR created_at < $3)
+				AND ($4::boolean OR NOT is_bot)`+filter+rolledUp+`
+		) v
+		GROUP BY 1
+		ORDER BY SUM(visits) DESC, 1
+		LIMIT $5`, linkID, from, to, includeBots, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []BreakdownEntry{}
+	for rows.Next() {
+		var entry BreakdownEntry
+		if err := rows.Scan(&entry.Value, &entry.Visits); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"shurl/src/export"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// HandleLinkVisitExport streams the raw visits of one link as CSV or NDJSON
+func HandleLinkVisitExport(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		linkID, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+		writeExport(c, db, &linkID, fmt.Sprintf("visits-link-%d", linkID))
+	}
+}
+
+// HandleVisitExport streams the raw visits of all links as CSV or NDJSON
+func HandleVisitExport(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeExport(c, db, nil, "visits")
+	}
+}
+
+// writeExport reads format (csv by default), from, to and include_bots and streams the matching
+// visits as an attachment. Errors after the first rows have been sent can only end the download early.
+func writeExport(c *gin.Context, db *sql.DB, linkID *int, name string) {
+	logger := requestLogger(c)
+	format, err := export.ParseFormat(c.DefaultQuery("format", string(export.FormatCSV)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": err.Error()})
+		return
+	}
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	includeBots, ok := parseIncludeBots(c)
+	if !ok {
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Type", format.ContentType())
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	q := export.Query{LinkID: linkID, From: from, To: to, IncludeBots: includeBots}
+	n, err := export.Write(c.Request.Context(), db, c.Writer, format, q, c.Writer.Flush)
+	if err != nil {
+		logger.Error("visit export failed", zap.Any("id", linkID), zap.Int("rows", n), zap.Error(err))
+		c.Abort()
+		return
+	}
+	logger.Info("visits exported", zap.Any("id", linkID), zap.String("format", string(format)), zap.Int("rows", n))
+}
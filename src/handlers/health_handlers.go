@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"shurl/src/anomaly"
+	"shurl/src/config"
+	"shurl/src/geoip"
+	"shurl/src/linkcache"
+	"shurl/src/migrations"
+	"shurl/src/recorder"
+	"shurl/src/retention"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// MigrationCheck compares the schema version of the database with the newest migration
+type MigrationCheck struct {
+	CheckResult
+	Version  uint `json:"version"`
+	Expected uint `json:"expected"`
+	Dirty    bool `json:"dirty"`
+}
+
+// WorkerState summarises a background worker: running, idle, saturated, failing, not_loaded,
+// disabled or stopped. Only a stopped visit recorder makes the service unready.
+type WorkerState struct {
+	State     string     `json:"state"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+}
+
+// HandleHealthz reports that the process is alive and serving requests. It checks nothing else, so
+// that a database outage does not get every replica restarted.
+func HandleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "alive"})
+}
+
+// HandleReadyz reports whether this replica should receive traffic: the database must answer a
+// ping within READINESS_TIMEOUT, its schema must be at least at the newest embedded migration
+// and clean, and the visit recorder must still be accepting visits. The state of every background
+// worker is included. Errors are logged rather than returned, as the endpoint is unauthenticated.
+func HandleReadyz(db *sql.DB, rec *recorder.Recorder, cache *linkcache.Cache, geo *geoip.Enricher, rollups *retention.Scheduler, anomalies *anomaly.Detector) gin.HandlerFunc {
+	timeout := config.GetEnvDuration("READINESS_TIMEOUT", 2*time.Second)
+	expected, err := migrations.Latest()
+	if err != nil {
+		config.GetLogger().Error("failed to read the embedded migrations", zap.Error(err))
+	}
+
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		database := pingDatabase(ctx, db)
+		schema := MigrationCheck{Expected: expected}
+		if database.OK {
+			schema = checkMigrations(ctx, db, expected)
+		} else {
+			schema.Error = "database unreachable"
+		}
+
+		recorderStats := rec.Stats()
+		workers := gin.H{
+			"visit_recorder": recorderState(recorderStats),
+			"link_cache":     enabledState(cache.Stats().Enabled),
+			"geoip":          geoState(geo.Stats()),
+			"visit_rollups":  rollupState(rollups.Stats()),
+			"anomalies":      anomalyState(anomalies.Stats()),
+		}
+
+		status, message, code := "success", "ready", http.StatusOK
+		if !database.OK || !schema.OK || recorderStats.Closed {
+			status, message, code = "error", "not ready", http.StatusServiceUnavailable
+		}
+		c.JSON(code, gin.H{
+			"status":  status,
+			"message": message,
+			"data": gin.H{
+				"database":   database,
+				"migrations": schema,
+				"workers":    workers,
+			},
+		})
+	}
+}
+
+// pingDatabase checks that a connection to the database can be used
+func pingDatabase(ctx context.Context, db *sql.DB) CheckResult {
+	start := time.Now()
+	err := db.PingContext(ctx)
+	result := CheckResult{OK: err == nil, LatencyMs: milliseconds(time.Since(start))}
+	if err != nil {
+		config.LoggerFromContext(ctx).Error("readiness check failed to ping database", zap.Error(err))
+		result.Error = "database unreachable"
+	}
+	return result
+}
+
+// checkMigrations reads the version golang-migrate recorded in schema_migrations. A newer schema is
+// accepted, so replicas of the previous release stay ready while a deployment migrates forward.
+func checkMigrations(ctx context.Context, db *sql.DB, expected uint) MigrationCheck {
+	start := time.Now()
+	check := MigrationCheck{Expected: expected}
+	var version int64
+	err := db.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &check.Dirty)
+	check.LatencyMs = milliseconds(time.Since(start))
+	switch {
+	case err == sql.ErrNoRows:
+		check.Error = "no migrations applied"
+	case err != nil:
+		config.LoggerFromContext(ctx).Error("readiness check failed to read schema_migrations", zap.Error(err))
+		check.Error = "failed to read schema version"
+	case check.Dirty:
+		check.Version = uint(version)
+		check.Error = "a migration failed part way"
+	case uint(version) < expected:
+		check.Version = uint(version)
+		check.Error = "pending migrations"
+	default:
+		check.Version = uint(version)
+		check.OK = true
+	}
+	return check
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func enabledState(enabled bool) WorkerState {
+	if !enabled {
+		return WorkerState{State: "disabled"}
+	}
+	return WorkerState{State: "running"}
+}
+
+func recorderState(stats recorder.Stats) WorkerState {
+	switch {
+	case stats.Closed:
+		return WorkerState{State: "stopped"}
+	case stats.QueueDepth >= stats.QueueCapacity:
+		return WorkerState{State: "saturated"}
+	}
+	return WorkerState{State: "running"}
+}
+
+func geoState(stats geoip.Stats) WorkerState {
+	switch {
+	case !stats.Enabled:
+		return WorkerState{State: "disabled"}
+	case !stats.Loaded:
+		return WorkerState{State: "not_loaded"}
+	}
+	return WorkerState{State: "running"}
+}
+
+// scheduledState summarises a periodic job from its last run
+func scheduledState(enabled, running bool, lastRunAt *time.Time, lastError string) WorkerState {
+	state := WorkerState{State: "idle", LastRunAt: lastRunAt}
+	switch {
+	case !enabled:
+		state.State = "disabled"
+	case running:
+		state.State = "running"
+	case lastError != "":
+		state.State = "failing"
+	}
+	return state
+}
+
+func rollupState(stats retention.Stats) WorkerState {
+	return scheduledState(stats.Enabled, stats.Running, stats.LastRunAt, stats.LastError)
+}
+
+func anomalyState(stats anomaly.Stats) WorkerState {
+	return scheduledState(stats.Enabled, stats.Running, stats.LastRunAt, stats.LastError)
+}
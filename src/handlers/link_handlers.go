@@ -3,9 +3,12 @@ package handlers
 import (
 	"database/sql"
 	"net/http"
+	"shurl/src/linkcache"
+	"shurl/src/metrics"
 	"shurl/src/models"
 	"shurl/src/validation"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,9 +16,55 @@ import (
 	"go.uber.org/zap"
 )
 
+// linkColumns is the column list scanned by scanLink
+const linkColumns = `id, url, code, visits_count, created_at, updated_at, expires_at,
+	og_title, og_description, og_image, ios_url, android_url, app_store_url, play_store_url,
+	utm_source, utm_medium, utm_campaign, utm_term, utm_content`
+
+// reservedCodes are top-level paths served by the application, which a custom alias could otherwise
+// shadow or be shadowed by
+var reservedCodes = map[string]bool{
+	"api": true, "dashboard": true, "healthz": true, "links": true, "metrics": true, "readyz": true, "static": true,
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanLink scans a row selected with linkColumns into link
+func scanLink(row rowScanner, link *models.Link) error {
+	return row.Scan(
+		&link.ID, &link.URL, &link.Code, &link.VisitsCount, &link.CreatedAt, &link.UpdatedAt, &link.ExpiresAt,
+		&link.OGTitle, &link.OGDescription, &link.OGImage,
+		&link.IOSURL, &link.AndroidURL, &link.AppStoreURL, &link.PlayStoreURL,
+		&link.UTMSource, &link.UTMMedium, &link.UTMCampaign, &link.UTMTerm, &link.UTMContent,
+	)
+}
+
+// validateExpiresAt rejects expiration times that are not in the future, writing the error response
+func validateExpiresAt(c *gin.Context, expiresAt *time.Time) bool {
+	if expiresAt == nil || expiresAt.After(time.Now()) {
+		return true
+	}
+	requestLogger(c).Error("expires_at must be in the future")
+	c.JSON(http.StatusBadRequest, gin.H{
+		"status":  "error",
+		"message": "Expiration date/time must be in the future",
+		"data": []gin.H{{
+			"field":    "expires_at",
+			"message":  "Expiration date/time must be in the future",
+			"location": "body",
+			"value":    expiresAt,
+		}},
+	})
+	return false
+}
+
 // HandleGenerateLink handles the request to generate a short URL
-func HandleGenerateLink(db *sql.DB) gin.HandlerFunc {
+func HandleGenerateLink(db *sql.DB, cache *linkcache.Cache) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := requestLogger(c)
 		var inputUrl models.InputUrl
 		logger.Info("binding inputUrl")
 		if err := c.ShouldBindJSON(&inputUrl); err != nil {
@@ -26,28 +75,23 @@ func HandleGenerateLink(db *sql.DB) gin.HandlerFunc {
 		logger.Info("inputUrl bound")
 
 		// Manual validation for expires_at
-		if inputUrl.ExpiresAt != nil {
-			if inputUrl.ExpiresAt.Before(time.Now()) || inputUrl.ExpiresAt.Equal(time.Now()) {
-				logger.Error("expires_at must be in the future")
-				c.JSON(http.StatusBadRequest, gin.H{
-					"status":  "error",
-					"message": "Expiration date/time must be in the future",
-					"data": []gin.H{{
-						"field":    "expires_at",
-						"message":  "Expiration date/time must be in the future",
-						"location": "body",
-						"value":    inputUrl.ExpiresAt,
-					}},
-				})
-				return
-			}
+		if !validateExpiresAt(c, inputUrl.ExpiresAt) {
+			return
+		}
+		if inputUrl.UTMPresetID != nil && !applyUTMPreset(c, db, *inputUrl.UTMPresetID, &inputUrl.UTM) {
+			return
 		}
 
 		customAlias := inputUrl.CustomAlias
+		if reservedCodes[strings.ToLower(customAlias)] {
+			logger.Info("customAlias is reserved", zap.String("customAlias", customAlias))
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "custom alias is reserved"})
+			return
+		}
 		if customAlias != "" {
 			var existingUrl string
 			logger.Info("checking if custom alias is already in database", zap.String("customAlias", customAlias))
-			if err := db.QueryRow("SELECT url FROM links WHERE code = $1", customAlias).Scan(&existingUrl); err != nil {
+			if err := db.QueryRowContext(c.Request.Context(), "SELECT url FROM links WHERE code = $1", customAlias).Scan(&existingUrl); err != nil {
 				if err == sql.ErrNoRows {
 					logger.Info("customAlias is not in database", zap.String("customAlias", customAlias))
 				} else {
@@ -68,7 +112,7 @@ func HandleGenerateLink(db *sql.DB) gin.HandlerFunc {
 				customAlias = uuid.New().String()[:6]
 				logger.Info("customAlias generated", zap.String("customAlias", customAlias))
 				var existingUrl string
-				err := db.QueryRow("SELECT url FROM links WHERE code = $1", customAlias).Scan(&existingUrl)
+				err := db.QueryRowContext(c.Request.Context(), "SELECT url FROM links WHERE code = $1", customAlias).Scan(&existingUrl)
 				if err == sql.ErrNoRows {
 					logger.Info("generated customAlias is unique", zap.String("customAlias", customAlias))
 					break
@@ -89,17 +133,25 @@ func HandleGenerateLink(db *sql.DB) gin.HandlerFunc {
 
 		logger.Info("inserting url into database")
 		var createdLink models.Link
-		sqlStatement := `INSERT INTO links (url, code, expires_at) VALUES ($1, $2, $3) RETURNING id, url, code, visits_count, created_at, updated_at, expires_at`
-		err := db.QueryRow(sqlStatement, inputUrl.URL, inputUrl.CustomAlias, inputUrl.ExpiresAt).Scan(
-			&createdLink.ID, &createdLink.URL, &createdLink.Code, &createdLink.VisitsCount,
-			&createdLink.CreatedAt, &createdLink.UpdatedAt, &createdLink.ExpiresAt,
-		)
+		sqlStatement := `INSERT INTO links (url, code, expires_at, og_title, og_description, og_image,
+				ios_url, android_url, app_store_url, play_store_url,
+				utm_source, utm_medium, utm_campaign, utm_term, utm_content)
+			VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''),
+				NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''),
+				NULLIF($11, ''), NULLIF($12, ''), NULLIF($13, ''), NULLIF($14, ''), NULLIF($15, '')) RETURNING ` + linkColumns
+		err := scanLink(db.QueryRowContext(c.Request.Context(), sqlStatement, inputUrl.URL, inputUrl.CustomAlias, inputUrl.ExpiresAt,
+			inputUrl.OGTitle, inputUrl.OGDescription, inputUrl.OGImage,
+			inputUrl.IOSURL, inputUrl.AndroidURL, inputUrl.AppStoreURL, inputUrl.PlayStoreURL,
+			inputUrl.UTMSource, inputUrl.UTMMedium, inputUrl.UTMCampaign, inputUrl.UTMTerm, inputUrl.UTMContent), &createdLink)
 		if err != nil {
 			logger.Error("failed to insert url into database", zap.Error(err))
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to insert url into database"})
 			return
 		}
 		logger.Info("url inserted into database")
+		metrics.LinkCreated()
+		// Drop any cached "not found" entry for the new code
+		cache.Invalidate(createdLink.Code)
 		c.JSON(
 			http.StatusCreated,
 			gin.H{
@@ -114,6 +166,7 @@ func HandleGenerateLink(db *sql.DB) gin.HandlerFunc {
 // HandleListLinks handles the request to list all links
 func HandleListLinks(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := requestLogger(c)
 		page, offset := c.DefaultQuery("page", "1"), c.DefaultQuery("offset", "100")
 		pageInt, _ := strconv.Atoi(page)
 		offsetInt, _ := strconv.Atoi(offset)
@@ -124,7 +177,7 @@ func HandleListLinks(db *sql.DB) gin.HandlerFunc {
 			offsetInt = 10
 		}
 
-		rows, err := db.Query("SELECT id, url, code, visits_count, created_at, updated_at, expires_at FROM links ORDER BY created_at DESC LIMIT $1 OFFSET $2", offsetInt, (pageInt-1)*offsetInt)
+		rows, err := db.QueryContext(c.Request.Context(), "SELECT "+linkColumns+" FROM links ORDER BY created_at DESC LIMIT $1 OFFSET $2", offsetInt, (pageInt-1)*offsetInt)
 		if err != nil {
 			logger.Error("failed to query rows", zap.Error(err))
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query rows"})
@@ -135,7 +188,7 @@ func HandleListLinks(db *sql.DB) gin.HandlerFunc {
 		var links []models.Link
 		for rows.Next() {
 			var link models.Link
-			err = rows.Scan(&link.ID, &link.URL, &link.Code, &link.VisitsCount, &link.CreatedAt, &link.UpdatedAt, &link.ExpiresAt)
+			err = scanLink(rows, &link)
 			if err != nil {
 				logger.Error("failed to scan row", zap.Error(err))
 				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan row"})
@@ -152,9 +205,10 @@ func HandleListLinks(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-// HandleDeleteLink handles the request to delete a link
-func HandleDeleteLink(db *sql.DB) gin.HandlerFunc {
+// HandleUpdateLink handles the request to replace the editable fields of a link
+func HandleUpdateLink(db *sql.DB, cache *linkcache.Cache) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := requestLogger(c)
 		id := c.Param("id")
 		idInt, err := strconv.Atoi(id)
 		if err != nil {
@@ -162,25 +216,76 @@ func HandleDeleteLink(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		_, err = db.Exec("DELETE FROM visits WHERE link_id = $1", idInt)
+		var input models.UpdateLink
+		if err := c.ShouldBindJSON(&input); err != nil {
+			logger.Error("failed to bind link update", zap.Error(err))
+			validation.HandleValidationErrors(c, err, input)
+			return
+		}
+		if !validateExpiresAt(c, input.ExpiresAt) {
+			return
+		}
+		if input.UTMPresetID != nil && !applyUTMPreset(c, db, *input.UTMPresetID, &input.UTM) {
+			return
+		}
+
+		var link models.Link
+		sqlStatement := `UPDATE links SET url = $1, expires_at = $2,
+			og_title = NULLIF($3, ''), og_description = NULLIF($4, ''), og_image = NULLIF($5, ''),
+			ios_url = NULLIF($6, ''), android_url = NULLIF($7, ''),
+			app_store_url = NULLIF($8, ''), play_store_url = NULLIF($9, ''),
+			utm_source = NULLIF($10, ''), utm_medium = NULLIF($11, ''), utm_campaign = NULLIF($12, ''),
+			utm_term = NULLIF($13, ''), utm_content = NULLIF($14, ''),
+			updated_at = CURRENT_TIMESTAMP
+			WHERE id = $15 RETURNING ` + linkColumns
+		err = scanLink(db.QueryRowContext(c.Request.Context(), sqlStatement, input.URL, input.ExpiresAt,
+			input.OGTitle, input.OGDescription, input.OGImage,
+			input.IOSURL, input.AndroidURL, input.AppStoreURL, input.PlayStoreURL,
+			input.UTMSource, input.UTMMedium, input.UTMCampaign, input.UTMTerm, input.UTMContent, idInt), &link)
 		if err != nil {
-			logger.Error("failed to delete associated visits", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to delete associated visits"})
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "link not found"})
+			} else {
+				logger.Error("failed to update link", zap.Int("id", idInt), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update link"})
+			}
 			return
 		}
+		cache.Invalidate(link.Code)
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link updated successfully", "data": link})
+	}
+}
 
-		result, err := db.Exec("DELETE FROM links WHERE id = $1", idInt)
+// HandleDeleteLink handles the request to delete a link
+func HandleDeleteLink(db *sql.DB, cache *linkcache.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		id := c.Param("id")
+		idInt, err := strconv.Atoi(id)
 		if err != nil {
-			logger.Error("failed to delete link", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to delete link"})
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid link ID format"})
 			return
 		}
 
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected == 0 {
-			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "link not found"})
+		_, err = db.ExecContext(c.Request.Context(), "DELETE FROM visits WHERE link_id = $1", idInt)
+		if err != nil {
+			logger.Error("failed to delete associated visits", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to delete associated visits"})
+			return
+		}
+
+		var code string
+		err = db.QueryRowContext(c.Request.Context(), "DELETE FROM links WHERE id = $1 RETURNING code", idInt).Scan(&code)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "link not found"})
+			} else {
+				logger.Error("failed to delete link", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to delete link"})
+			}
 			return
 		}
+		cache.Invalidate(code)
 		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link deleted successfully"})
 	}
 }
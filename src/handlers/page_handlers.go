@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"shurl/src/config"
 	"shurl/src/models"
 	"strconv"
 
@@ -12,16 +13,14 @@ import (
 	"go.uber.org/zap"
 )
 
-// Logger instance
-var logger *zap.Logger
-
-// SetLogger sets the logger for handlers
-func SetLogger(l *zap.Logger) {
-	logger = l
+// requestLogger returns the logger of the request, which carries its ID, route and client IP
+func requestLogger(c *gin.Context) *zap.Logger {
+	return config.LoggerFromContext(c.Request.Context())
 }
 
 // HandleIndex handles the index page request
 func HandleIndex(c *gin.Context) {
+	logger := requestLogger(c)
 	tmpl, err := template.ParseFiles("src/templates/base.html", "src/templates/index.html")
 	if err != nil {
 		logger.Error("failed to parse templates", zap.Error(err))
@@ -38,9 +37,39 @@ func HandleIndex(c *gin.Context) {
 	}
 }
 
-// HandleVisitDetails handles the visit details page
+// HandleDashboard handles the analytics dashboard page. Its panels load themselves from the
+// aggregate stats endpoints for the range picked on the page.
+func HandleDashboard(c *gin.Context) {
+	logger := requestLogger(c)
+	tmpl, err := template.ParseFiles("src/templates/base.html", "src/templates/dashboard.html")
+	if err != nil {
+		logger.Error("failed to parse dashboard templates", zap.Error(err))
+		c.String(http.StatusInternalServerError, "Error rendering page")
+		return
+	}
+
+	err = tmpl.ExecuteTemplate(c.Writer, "base", gin.H{
+		"Title":          "Analytics Dashboard",
+		"ShowBackButton": true,
+	})
+	if err != nil {
+		logger.Error("failed to execute dashboard template", zap.Error(err))
+	}
+}
+
+// visitDetailBreakdowns are the breakdown panels of the visit details page, in display order
+var visitDetailBreakdowns = []struct{ Dimension, Title string }{
+	{"referrer", "Top Referrers"},
+	{"browser", "Browsers"},
+	{"os", "Operating Systems"},
+	{"country", "Top Countries"},
+}
+
+// HandleVisitDetails handles the visit details page. Only the link is rendered on the server; the
+// chart, breakdowns and visit table load from the JSON API for the range and filters picked on the page.
 func HandleVisitDetails(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		logger := requestLogger(c)
 		id := c.Param("id")
 		idInt, err := strconv.Atoi(id)
 		if err != nil {
@@ -50,8 +79,7 @@ func HandleVisitDetails(db *sql.DB) gin.HandlerFunc {
 		}
 
 		var link models.Link
-		err = db.QueryRow("SELECT id, url, code, visits_count, created_at, updated_at, expires_at FROM links WHERE id = $1", idInt).Scan(
-			&link.ID, &link.URL, &link.Code, &link.VisitsCount, &link.CreatedAt, &link.UpdatedAt, &link.ExpiresAt)
+		err = scanLink(db.QueryRowContext(c.Request.Context(), "SELECT "+linkColumns+" FROM links WHERE id = $1", idInt), &link)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				logger.Warn("link not found for visit details", zap.Int("id", idInt))
@@ -63,27 +91,18 @@ func HandleVisitDetails(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query("SELECT id, link_id, ip_address, user_agent, referrer, created_at, updated_at FROM visits WHERE link_id = $1 ORDER BY created_at DESC", id)
-		if err != nil {
-			logger.Error("failed to query visit rows", zap.Error(err))
-			c.String(http.StatusInternalServerError, "Error fetching visits")
-			return
-		}
-		defer rows.Close()
+		// Bot visits are hidden unless the page is opened with include_bots=true
+		includeBots, _ := strconv.ParseBool(c.Query("include_bots"))
 
-		var visits []models.Visit
-		for rows.Next() {
-			var visit models.Visit
-			err = rows.Scan(&visit.ID, &visit.LinkID, &visit.IPAddress, &visit.UserAgent, &visit.Referrer, &visit.CreatedAt, &visit.UpdatedAt)
-			if err != nil {
-				logger.Error("failed to scan visit row", zap.Error(err))
-				c.String(http.StatusInternalServerError, "Error reading visit data")
-				return
-			}
-			visits = append(visits, visit)
-		}
-		if err = rows.Err(); err != nil {
-			logger.Error("error iterating visit rows", zap.Error(err))
+		// Scans of days past the retention period only remain in the rollups
+		var qrVisits int
+		err = db.QueryRowContext(c.Request.Context(), `SELECT
+				(SELECT COUNT(*) FROM visits
+					WHERE link_id = $1 AND source = 'qr' AND ($2::boolean OR NOT is_bot))
+				+ (SELECT COALESCE(SUM(visits), 0) FROM visit_daily_rollups
+					WHERE link_id = $1 AND source = 'qr' AND ($2::boolean OR NOT is_bot))`, idInt, includeBots).Scan(&qrVisits)
+		if err != nil {
+			logger.Error("failed to count QR visits", zap.Int("id", idInt), zap.Error(err))
 			c.String(http.StatusInternalServerError, "Error reading visits")
 			return
 		}
@@ -98,7 +117,9 @@ func HandleVisitDetails(db *sql.DB) gin.HandlerFunc {
 		err = tmpl.ExecuteTemplate(c.Writer, "base", gin.H{
 			"Title":          fmt.Sprintf("Visit Details for - %s", link.URL),
 			"ShowBackButton": true,
-			"Visits":         visits,
+			"QRVisits":       qrVisits,
+			"Breakdowns":     visitDetailBreakdowns,
+			"IncludeBots":    includeBots,
 			"Link":           link,
 		})
 		if err != nil {
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/url"
+	"shurl/src/linkcache"
+	"shurl/src/models"
+	"shurl/src/validation"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// pixelColumns is the column list scanned by scanPixel
+const pixelColumns = "id, name, kind, template, created_at, updated_at"
+
+// scanPixel scans a row selected with pixelColumns into pixel
+func scanPixel(row rowScanner, pixel *models.Pixel) error {
+	return row.Scan(&pixel.ID, &pixel.Name, &pixel.Kind, &pixel.Template, &pixel.CreatedAt, &pixel.UpdatedAt)
+}
+
+// queryPixels runs a query selecting pixelColumns and collects the rows
+func queryPixels(ctx context.Context, db *sql.DB, query string, args ...any) ([]models.Pixel, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pixels := []models.Pixel{}
+	for rows.Next() {
+		var pixel models.Pixel
+		if err := scanPixel(rows, &pixel); err != nil {
+			return nil, err
+		}
+		pixels = append(pixels, pixel)
+	}
+	return pixels, rows.Err()
+}
+
+// linkPixels returns the pixels attached to a link
+func linkPixels(ctx context.Context, db *sql.DB, linkID int) ([]models.Pixel, error) {
+	return queryPixels(ctx, db, `SELECT p.id, p.name, p.kind, p.template, p.created_at, p.updated_at
+		FROM pixels p JOIN link_pixels lp ON lp.pixel_id = p.id
+		WHERE lp.link_id = $1 ORDER BY p.id`, linkID)
+}
+
+// pixelPage is the data for the pixel snippets rendered on an interstitial page
+type pixelPage struct {
+	Images  []string
+	Scripts []template.JS
+	Timeout int64
+}
+
+// expandPixels substitutes the link placeholders into the pixel templates. Values are
+// query-escaped for image URLs and JavaScript-string-escaped for scripts.
+func expandPixels(pixels []models.Pixel, link models.Link, destination string, timeout time.Duration) pixelPage {
+	values := map[string]string{
+		"{code}":    link.Code,
+		"{link_id}": strconv.Itoa(link.ID),
+		"{url}":     destination,
+	}
+	replacer := func(escape func(string) string) *strings.Replacer {
+		var pairs []string
+		for placeholder, value := range values {
+			pairs = append(pairs, placeholder, escape(value))
+		}
+		return strings.NewReplacer(pairs...)
+	}
+	imageReplacer := replacer(url.QueryEscape)
+	scriptReplacer := replacer(template.JSEscapeString)
+
+	page := pixelPage{Timeout: timeout.Milliseconds()}
+	for _, pixel := range pixels {
+		switch pixel.Kind {
+		case models.PixelKindImage:
+			page.Images = append(page.Images, imageReplacer.Replace(pixel.Template))
+		case models.PixelKindScript:
+			// Script pixels are authored by admins and are trusted
+			page.Scripts = append(page.Scripts, template.JS(scriptReplacer.Replace(pixel.Template)))
+		}
+	}
+	return page
+}
+
+// renderPixelBounce serves a page that fires the link's pixels and then redirects to the destination,
+// giving up on slow pixels after the timeout
+func renderPixelBounce(c *gin.Context, pixels pixelPage, destination string) {
+	logger := requestLogger(c)
+	tmpl, err := template.ParseFiles("src/templates/pixels.html")
+	if err != nil {
+		logger.Error("failed to parse pixels template", zap.Error(err))
+		c.Redirect(http.StatusTemporaryRedirect, destination)
+		return
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+	err = tmpl.ExecuteTemplate(c.Writer, "pixel_bounce", gin.H{
+		"Pixels":      pixels,
+		"Destination": destination,
+	})
+	if err != nil {
+		logger.Error("failed to execute pixels template", zap.Error(err))
+	}
+}
+
+// HandleListPixels returns all pixels ordered by name
+func HandleListPixels(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pixels, err := queryPixels(c.Request.Context(), db, "SELECT "+pixelColumns+" FROM pixels ORDER BY name")
+		if err != nil {
+			requestLogger(c).Error("failed to query pixels", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query pixels"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "pixels fetched successfully", "data": pixels})
+	}
+}
+
+// HandleCreatePixel creates a reusable pixel snippet
+func HandleCreatePixel(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		var input models.InputPixel
+		if err := c.ShouldBindJSON(&input); err != nil {
+			logger.Error("failed to bind pixel", zap.Error(err))
+			validation.HandleValidationErrors(c, err, input)
+			return
+		}
+
+		var pixel models.Pixel
+		err := scanPixel(db.QueryRowContext(c.Request.Context(), "INSERT INTO pixels (name, kind, template) VALUES ($1, $2, $3) RETURNING "+pixelColumns,
+			input.Name, input.Kind, input.Template), &pixel)
+		if err != nil {
+			if isUniqueViolation(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "pixel name already exists"})
+				return
+			}
+			logger.Error("failed to insert pixel", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to insert pixel"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"status": "success", "message": "pixel created successfully", "data": pixel})
+	}
+}
+
+// HandleUpdatePixel replaces a pixel. Every link it is attached to picks up the change.
+func HandleUpdatePixel(db *sql.DB, cache *linkcache.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		idInt, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid pixel ID format"})
+			return
+		}
+
+		var input models.InputPixel
+		if err := c.ShouldBindJSON(&input); err != nil {
+			logger.Error("failed to bind pixel", zap.Error(err))
+			validation.HandleValidationErrors(c, err, input)
+			return
+		}
+
+		var pixel models.Pixel
+		err = scanPixel(db.QueryRowContext(c.Request.Context(), `UPDATE pixels SET name = $1, kind = $2, template = $3, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $4 RETURNING `+pixelColumns, input.Name, input.Kind, input.Template, idInt), &pixel)
+		if err != nil {
+			switch {
+			case err == sql.ErrNoRows:
+				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "pixel not found"})
+			case isUniqueViolation(err):
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "pixel name already exists"})
+			default:
+				logger.Error("failed to update pixel", zap.Int("id", idInt), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update pixel"})
+			}
+			return
+		}
+		// The pixel may be attached to any number of cached links
+		cache.InvalidateAll()
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "pixel updated successfully", "data": pixel})
+	}
+}
+
+// HandleDeletePixel deletes a pixel and detaches it from all links
+func HandleDeletePixel(db *sql.DB, cache *linkcache.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idInt, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid pixel ID format"})
+			return
+		}
+
+		result, err := db.ExecContext(c.Request.Context(), "DELETE FROM pixels WHERE id = $1", idInt)
+		if err != nil {
+			requestLogger(c).Error("failed to delete pixel", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to delete pixel"})
+			return
+		}
+
+		rowsAffected, _ := result.RowsAffected()
+		if rowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "pixel not found"})
+			return
+		}
+		cache.InvalidateAll()
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "pixel deleted successfully"})
+	}
+}
+
+// HandleLinkPixels returns the pixels attached to a link
+func HandleLinkPixels(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idInt, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid link ID format"})
+			return
+		}
+
+		pixels, err := linkPixels(c.Request.Context(), db, idInt)
+		if err != nil {
+			requestLogger(c).Error("failed to query link pixels", zap.Int("id", idInt), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query link pixels"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link pixels fetched successfully", "data": pixels})
+	}
+}
+
+// HandleSetLinkPixels replaces the set of pixels attached to a link
+func HandleSetLinkPixels(db *sql.DB, cache *linkcache.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		idInt, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid link ID format"})
+			return
+		}
+
+		var input models.InputLinkPixels
+		if err := c.ShouldBindJSON(&input); err != nil {
+			logger.Error("failed to bind link pixels", zap.Error(err))
+			validation.HandleValidationErrors(c, err, input)
+			return
+		}
+
+		tx, err := db.BeginTx(c.Request.Context(), nil)
+		if err != nil {
+			logger.Error("failed to begin transaction", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update link pixels"})
+			return
+		}
+		defer tx.Rollback()
+
+		var code string
+		if err := tx.QueryRowContext(c.Request.Context(), "SELECT code FROM links WHERE id = $1", idInt).Scan(&code); err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "link not found"})
+			} else {
+				logger.Error("failed to query link", zap.Int("id", idInt), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update link pixels"})
+			}
+			return
+		}
+
+		if _, err := tx.ExecContext(c.Request.Context(), "DELETE FROM link_pixels WHERE link_id = $1", idInt); err != nil {
+			logger.Error("failed to clear link pixels", zap.Int("id", idInt), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update link pixels"})
+			return
+		}
+		result, err := tx.ExecContext(c.Request.Context(), `INSERT INTO link_pixels (link_id, pixel_id)
+			SELECT $1, id FROM pixels WHERE id = ANY($2)`, idInt, pq.Array(input.PixelIDs))
+		if err != nil {
+			logger.Error("failed to attach link pixels", zap.Int("id", idInt), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update link pixels"})
+			return
+		}
+		if attached, _ := result.RowsAffected(); int(attached) != len(uniqueInts(input.PixelIDs)) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "one or more pixels not found"})
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			logger.Error("failed to commit link pixels", zap.Int("id", idInt), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update link pixels"})
+			return
+		}
+		cache.Invalidate(code)
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link pixels updated successfully"})
+	}
+}
+
+// uniqueInts returns values with duplicates removed
+func uniqueInts(values []int) []int {
+	seen := make(map[int]bool, len(values))
+	var unique []int
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
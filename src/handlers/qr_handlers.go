@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"shurl/src/linkcache"
+	"shurl/src/qr"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// qrSourceParam marks a redirect as coming from a QR code scan
+const qrSourceParam = "qr"
+
+// HandleLinkQR renders a QR code for the short URL of a link looked up by ID
+func HandleLinkQR(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		idInt, err := strconv.Atoi(id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid link ID format"})
+			return
+		}
+
+		var code string
+		err = db.QueryRowContext(c.Request.Context(), "SELECT code FROM links WHERE id = $1", idInt).Scan(&code)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "link not found"})
+			} else {
+				requestLogger(c).Error("failed to query link for qr code", zap.Int("id", idInt), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query link"})
+			}
+			return
+		}
+
+		renderQR(c, code)
+	}
+}
+
+// HandleCodeQR renders a QR code for the short URL of a link looked up by code
+func HandleCodeQR(cache *linkcache.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := c.Param("code")
+
+		entry, err := cache.Get(c.Request.Context(), code)
+		if err != nil {
+			requestLogger(c).Error("failed to query link for qr code", zap.String("code", code), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "internal server error"})
+			return
+		}
+		if !entry.Found {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "url not found"})
+			return
+		}
+
+		renderQR(c, code)
+	}
+}
+
+// renderQR writes the QR code image for a short code using the options in the query string
+func renderQR(c *gin.Context, code string) {
+	format, opts, err := parseQROptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": err.Error()})
+		return
+	}
+
+	data, err := qr.Render(qrContent(c, code), format, opts)
+	if err != nil {
+		requestLogger(c).Error("failed to render qr code", zap.String("code", code), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to render qr code"})
+		return
+	}
+
+	if c.Query("download") != "" {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-qr.%s"`, code, format))
+	}
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, format.ContentType(), data)
+}
+
+// parseQROptions reads format, size, level, margin, fg and bg from the query string
+func parseQROptions(c *gin.Context) (qr.Format, qr.Options, error) {
+	opts := qr.DefaultOptions()
+
+	format, err := qr.ParseFormat(c.Query("format"))
+	if err != nil {
+		return "", opts, err
+	}
+
+	if size := c.Query("size"); size != "" {
+		if opts.Size, err = strconv.Atoi(size); err != nil {
+			return "", opts, fmt.Errorf("size must be an integer")
+		}
+	}
+	if margin := c.Query("margin"); margin != "" {
+		if opts.Margin, err = strconv.Atoi(margin); err != nil {
+			return "", opts, fmt.Errorf("margin must be an integer")
+		}
+	}
+	if opts.Level, err = qr.ParseLevel(c.Query("level")); err != nil {
+		return "", opts, err
+	}
+	if fg := c.Query("fg"); fg != "" {
+		if opts.Foreground, err = qr.ParseColor(fg); err != nil {
+			return "", opts, err
+		}
+	}
+	if bg := c.Query("bg"); bg != "" {
+		if opts.Background, err = qr.ParseColor(bg); err != nil {
+			return "", opts, err
+		}
+	}
+
+	return format, opts, opts.Validate()
+}
+
+// qrContent returns the short URL encoded in the QR code, tagged so scans can be told apart from clicks
+func qrContent(c *gin.Context, code string) string {
+	return shortURL(c, code) + "?src=" + url.QueryEscape(qrSourceParam)
+}
+
+// shortURL builds the public short URL for a code. BASE_URL takes precedence over the request host,
+// since the service may sit behind a proxy with a different public name.
+func shortURL(c *gin.Context, code string) string {
+	base := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+	return base + "/" + url.PathEscape(code)
+}
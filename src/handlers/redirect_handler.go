@@ -1,16 +1,54 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"html/template"
 	"net/http"
+	"shurl/src/botdetect"
+	"shurl/src/config"
+	"shurl/src/linkcache"
+	"shurl/src/metrics"
+	"shurl/src/models"
+	"shurl/src/privacy"
+	"shurl/src/recorder"
+	"shurl/src/referrer"
+	"shurl/src/useragent"
+	"shurl/src/visitfeed"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
-// HandleRedirect redirects to the original URL when a short code is accessed
-func HandleRedirect(db *sql.DB) gin.HandlerFunc {
+// LinkCacheLoader loads the link and pixels for a short code from the database
+func LinkCacheLoader(db *sql.DB) linkcache.Loader {
+	return func(ctx context.Context, code string) (linkcache.Entry, error) {
+		var entry linkcache.Entry
+		err := scanLink(db.QueryRowContext(ctx, "SELECT "+linkColumns+" FROM links WHERE code = $1", code), &entry.Link)
+		if err == sql.ErrNoRows {
+			return entry, nil
+		}
+		if err != nil {
+			return entry, err
+		}
+		entry.Found = true
+		entry.Pixels, err = linkPixels(ctx, db, entry.Link.ID)
+		return entry, err
+	}
+}
+
+// HandleRedirect redirects to the original URL when a short code is accessed.
+// Links are looked up through the cache, and the visit is handed to the recorder,
+// which writes it and the click count in the background. The visit's referrer and
+// utm_* parameters are attributed to a source class with classifier, and visits that
+// detector flags as bots are stored without being counted. Every visit is also published
+// to feed for the live visit streams.
+func HandleRedirect(cache *linkcache.Cache, rec *recorder.Recorder, feed *visitfeed.Hub, classifier *referrer.Classifier, detector *botdetect.Detector) gin.HandlerFunc {
+	pixelTimeout := config.GetEnvDuration("PIXEL_TIMEOUT", time.Second)
+
 	return func(c *gin.Context) {
+		logger := requestLogger(c)
 		code := c.Param("code")
 		if code == "" {
 			logger.Error("code is required")
@@ -19,39 +57,127 @@ func HandleRedirect(db *sql.DB) gin.HandlerFunc {
 		}
 		logger.Info("searching for code", zap.String("code", code))
 
-		var url string
-		var linkId int
-		err := db.QueryRow("SELECT url, id FROM links WHERE code = $1", code).Scan(&url, &linkId)
+		entry, err := cache.Get(c.Request.Context(), code)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "url not found"})
-			} else {
-				logger.Error("failed to query row", zap.Error(err))
-				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "internal server error"})
-			}
+			logger.Error("failed to query row", zap.Error(err))
+			metrics.Redirect(metrics.OutcomeError)
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "internal server error"})
+			return
+		}
+		if !entry.Found {
+			metrics.Redirect(metrics.OutcomeNotFound)
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "url not found"})
 			return
 		}
+		link, pixels := entry.Link, entry.Pixels
+		if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+			logger.Info("link has expired", zap.String("code", code))
+			metrics.Redirect(metrics.OutcomeExpired)
+			c.JSON(http.StatusGone, gin.H{"status": "error", "message": "link has expired"})
+			return
+		}
+		// UTM parameters configured on the link are appended to the destination
+		url, linkId := link.Apply(link.URL), link.ID
 		logger.Info("found url", zap.String("url", url))
 
-		logger.Info("updating click count")
-		_, err = db.Exec("UPDATE links SET visits_count = visits_count + 1 WHERE id = $1", linkId)
-		if err != nil {
-			logger.Error("failed to update click count", zap.Error(err))
-		} else {
-			logger.Info("click count updated")
+		userAgent := c.Request.UserAgent()
+		clientIP := c.ClientIP()
+		isBot, botReason := detector.Detect(c.Request, clientIP)
+		visitUTM := recorder.UTM{
+			Source:   c.Query("utm_source"),
+			Medium:   c.Query("utm_medium"),
+			Campaign: c.Query("utm_campaign"),
+			Term:     c.Query("utm_term"),
+			Content:  c.Query("utm_content"),
+		}
+		ref := classifier.Classify(c.Request.Referer(), visitUTM.Medium, c.Request.Host)
+		visit := recorder.Visit{
+			LinkID:        linkId,
+			IPAddress:     clientIP,
+			UserAgent:     userAgent,
+			Referrer:      c.Request.Referer(),
+			ReferrerHost:  ref.Host,
+			ReferrerClass: ref.Class,
+			Source:        visitSource(c),
+			UTM:           visitUTM,
+			IsBot:         isBot,
+			DoNotTrack:    privacy.DoNotTrack(c.Request),
 		}
+		rec.Record(c.Request.Context(), visit)
+		feed.Publish(code, visit)
 
-		logger.Info("recording visit details")
-		referrer := c.Request.Referer()
-		ip := c.ClientIP()
-		userAgent := c.Request.UserAgent()
-		_, err = db.Exec("INSERT INTO visits (link_id, ip_address, user_agent, referrer) VALUES ($1, $2, $3, $4)", linkId, ip, userAgent, referrer)
-		if err != nil {
-			logger.Error("failed to record visit", zap.Error(err))
-		} else {
-			logger.Info("visit recorded")
+		// Bots are recorded but not counted, and get neither pixels nor app bounces.
+		// Link-preview crawlers are shown the link's social card.
+		if isBot {
+			logger.Info("bot request detected", zap.String("reason", botReason), zap.String("userAgent", userAgent))
+			metrics.Redirect(metrics.OutcomeBot)
+			if useragent.IsUnfurler(userAgent) && link.HasOverrides() {
+				renderSocialCard(c, link, url)
+				return
+			}
+			c.Redirect(http.StatusTemporaryRedirect, url)
+			return
+		}
+
+		metrics.Redirect(metrics.OutcomeHit)
+		pixelData := expandPixels(pixels, link, url, pixelTimeout)
+
+		platform := useragent.DetectPlatform(userAgent)
+		if appURL, storeURL := link.Target(platform); appURL != "" {
+			logger.Info("serving app bounce page", zap.String("platform", platform))
+			renderAppBounce(c, appURL, storeURL, url, pixelData)
+			return
+		}
+
+		// Links without pixels keep the plain HTTP redirect
+		if len(pixels) > 0 {
+			logger.Info("serving pixel page", zap.Int("pixels", len(pixels)))
+			renderPixelBounce(c, pixelData, url)
+			return
 		}
 
 		c.Redirect(http.StatusTemporaryRedirect, url)
 	}
 }
+
+// visitSource reports where a visit came from. The src marker added to QR codes is
+// only used for attribution and is never forwarded to the destination URL.
+func visitSource(c *gin.Context) string {
+	if c.Query("src") == qrSourceParam {
+		return "qr"
+	}
+	return "link"
+}
+
+// renderSocialCard serves a minimal page carrying the link's Open Graph overrides to an unfurling crawler
+func renderSocialCard(c *gin.Context, link models.Link, destination string) {
+	logger := requestLogger(c)
+	tmpl, err := template.ParseFiles("src/templates/social_card.html")
+	if err != nil {
+		logger.Error("failed to parse social_card template", zap.Error(err))
+		c.Redirect(http.StatusTemporaryRedirect, destination)
+		return
+	}
+
+	title := link.URL
+	if link.OGTitle != nil {
+		title = *link.OGTitle
+	}
+	data := gin.H{
+		"Title":    title,
+		"URL":      destination,
+		"ShortURL": shortURL(c, link.Code),
+	}
+	if link.OGDescription != nil {
+		data["Description"] = *link.OGDescription
+	}
+	if link.OGImage != nil {
+		data["Image"] = *link.OGImage
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := tmpl.ExecuteTemplate(c.Writer, "social_card", data); err != nil {
+		logger.Error("failed to execute social_card template", zap.Error(err))
+	}
+}
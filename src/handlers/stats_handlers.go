@@ -0,0 +1,589 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"shurl/src/visitorid"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// CampaignStats is the visit count of all links tagged with one utm_campaign
+type CampaignStats struct {
+	Campaign    string     `json:"campaign"`
+	Links       int        `json:"links"`
+	Visits      int        `json:"visits"`
+	LastVisitAt *time.Time `json:"last_visit_at"`
+}
+
+// parseTimeParam parses an optional RFC3339 timestamp or YYYY-MM-DD date from the query string.
+// Visit timestamps are stored in UTC, so the result is converted to UTC.
+func parseTimeParam(c *gin.Context, name string) (*time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s must be an RFC3339 timestamp or a YYYY-MM-DD date", name)
+}
+
+// parseTimeRange reads the optional from and to query parameters, writing the error response on failure
+func parseTimeRange(c *gin.Context) (from, to *time.Time, ok bool) {
+	var err error
+	if from, err = parseTimeParam(c, "from"); err == nil {
+		to, err = parseTimeParam(c, "to")
+	}
+	if err == nil && from != nil && to != nil && !from.Before(*to) {
+		err = fmt.Errorf("from must be before to")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": err.Error()})
+		return nil, nil, false
+	}
+	return from, to, true
+}
+
+// parseIncludeBots reads the include_bots toggle, writing the error response on failure.
+// Bot visits are left out of statistics unless it is set.
+func parseIncludeBots(c *gin.Context) (bool, bool) {
+	raw := c.Query("include_bots")
+	if raw == "" {
+		return false, true
+	}
+	include, err := strconv.ParseBool(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "include_bots must be true or false"})
+		return false, false
+	}
+	return include, true
+}
+
+// rollupDayRange selects the rolled-up days overlapping the optional range bound to $1 and $2.
+// A rolled-up day has no time of day, so a day at an edge of the range is counted whole.
+const rollupDayRange = `($1::timestamp IS NULL OR day >= $1::date)
+	AND ($2::timestamp IS NULL OR day < $2::timestamp)`
+
+// campaignAttributionNote is returned with campaign stats, which are attributed by each link's
+// current campaign rather than the one applied when the visit was redirected
+const campaignAttributionNote = "visits are grouped by each link's current utm_campaign; visits made before a link's campaign changed count towards its new campaign"
+
+// HandleCampaignStats groups visits across all links by the links' utm_campaign. Visits do not
+// record the link's campaign at redirect time, and rolled-up days keep no campaign at all, so a
+// link's whole history is attributed to its current campaign.
+func HandleCampaignStats(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		from, to, ok := parseTimeRange(c)
+		if !ok {
+			return
+		}
+		includeBots, ok := parseIncludeBots(c)
+		if !ok {
+			return
+		}
+
+		// Rolled-up days only know their date, which stands in for the last visit time
+		rows, err := db.QueryContext(c.Request.Context(), `SELECT l.utm_campaign, COUNT(DISTINCT l.id), COALESCE(SUM(v.visits), 0), MAX(v.last_visit_at)
+			FROM links l
+			LEFT JOIN (
+				SELECT link_id, COUNT(*) AS visits, MAX(created_at) AS last_visit_at
+				FROM visits
+				WHERE ($1::timestamp IS NULL OR created_at >= $1)
+					AND ($2::timestamp IS NULL OR created_at < $2)
+					AND ($3::boolean OR NOT is_bot)
+				GROUP BY link_id
+				UNION ALL
+				SELECT link_id, SUM(visits), MAX(day)::timestamp
+				FROM visit_daily_rollups
+				WHERE `+rollupDayRange+`
+					AND ($3::boolean OR NOT is_bot)
+				GROUP BY link_id
+			) v ON v.link_id = l.id
+			WHERE l.utm_campaign IS NOT NULL
+			GROUP BY l.utm_campaign
+			ORDER BY COALESCE(SUM(v.visits), 0) DESC, l.utm_campaign`, from, to, includeBots)
+		if err != nil {
+			logger.Error("failed to query campaign stats", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query campaign stats"})
+			return
+		}
+		defer rows.Close()
+
+		campaigns := []CampaignStats{}
+		for rows.Next() {
+			var stats CampaignStats
+			if err := rows.Scan(&stats.Campaign, &stats.Links, &stats.Visits, &stats.LastVisitAt); err != nil {
+				logger.Error("failed to scan campaign stats row", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan campaign stats row"})
+				return
+			}
+			campaigns = append(campaigns, stats)
+		}
+		if err = rows.Err(); err != nil {
+			logger.Error("error iterating campaign stats rows", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "error reading campaign stats"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "campaign stats fetched successfully", "note": campaignAttributionNote, "data": campaigns})
+	}
+}
+
+// maxSeriesBuckets bounds the number of points a time series query may return
+const maxSeriesBuckets = 2000
+
+// seriesIntervals maps the supported bucket sizes to their approximate length, used to bound the series
+var seriesIntervals = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 28 * 24 * time.Hour,
+}
+
+// exactUniquesMaxRange is the longest range for which unique visitors are counted exactly by default;
+// longer ranges are estimated from the daily HyperLogLog sketches
+const exactUniquesMaxRange = 92 * 24 * time.Hour
+
+// statsQuery holds the common parameters of the visit statistics endpoints
+type statsQuery struct {
+	From     time.Time
+	To       time.Time
+	Interval string
+	Location *time.Location
+	// IncludeBots counts bot visits along with human ones
+	IncludeBots bool
+	// Approximate estimates unique visitors from sketches rather than counting them
+	Approximate bool
+}
+
+// SeriesPoint is the visit count of one time bucket
+type SeriesPoint struct {
+	Bucket         time.Time `json:"bucket"`
+	Visits         int       `json:"visits"`
+	UniqueVisitors int       `json:"unique_visitors"`
+}
+
+// TimeSeries is a bucketed visit count over a time range
+type TimeSeries struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	Interval       string    `json:"interval"`
+	Timezone       string    `json:"tz"`
+	IncludeBots    bool      `json:"include_bots"`
+	Visits         int       `json:"visits"`
+	UniqueVisitors int       `json:"unique_visitors"`
+	// UniqueVisitorsApproximate is set when uniques are HyperLogLog estimates
+	UniqueVisitorsApproximate bool `json:"unique_visitors_approximate"`
+	// BotVisits is the number of bot visits in the range, whether or not they are included
+	BotVisits int           `json:"bot_visits"`
+	Series    []SeriesPoint `json:"series"`
+}
+
+// parseStatsQuery reads from, to, interval, tz, include_bots and uniques, writing the error response on failure.
+// The range defaults to the 30 days before now, bucketed by day in UTC. Uniques are counted exactly
+// up to exactUniquesMaxRange and estimated beyond, unless uniques is set to exact or approximate.
+func parseStatsQuery(c *gin.Context) (statsQuery, bool) {
+	q := statsQuery{Interval: c.DefaultQuery("interval", "day")}
+	if _, ok := seriesIntervals[q.Interval]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "interval must be one of hour, day, week or month"})
+		return q, false
+	}
+
+	// Go resolves "Local" to the server's own zone, which Postgres does not know by that name
+	tz := c.DefaultQuery("tz", "UTC")
+	location, err := time.LoadLocation(tz)
+	if err != nil || tz == "Local" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "tz must be an IANA time zone name"})
+		return q, false
+	}
+	q.Location = location
+
+	includeBots, ok := parseIncludeBots(c)
+	if !ok {
+		return q, false
+	}
+	q.IncludeBots = includeBots
+
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return q, false
+	}
+	q.To = time.Now().UTC()
+	if to != nil {
+		q.To = *to
+	}
+	q.From = q.To.AddDate(0, 0, -30)
+	if from != nil {
+		q.From = *from
+	}
+	if !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "from must be before to"})
+		return q, false
+	}
+
+	if buckets := q.To.Sub(q.From) / seriesIntervals[q.Interval]; buckets > maxSeriesBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("range too large for interval %s, at most %d buckets are returned", q.Interval, maxSeriesBuckets),
+		})
+		return q, false
+	}
+
+	switch c.DefaultQuery("uniques", "auto") {
+	case "auto":
+		q.Approximate = q.To.Sub(q.From) > exactUniquesMaxRange
+	case "exact":
+	case "approximate":
+		q.Approximate = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "uniques must be one of auto, exact or approximate"})
+		return q, false
+	}
+	// Sketches are kept per day, so hourly buckets are always exact
+	if q.Interval == "hour" {
+		q.Approximate = false
+	}
+	return q, true
+}
+
+// queryTimeSeries counts visits per bucket for one link, or for all links when linkID is nil.
+// Buckets are truncated in the requested time zone, and buckets without visits are returned as zero.
+// Unique visitors are distinct visitor hashes per UTC day, as the hash salt rotates daily: someone
+// visiting on three days is three visitors, and a visitor of two links is counted for each.
+//
+// Days past the retention period are read from visit_daily_rollups. They are counted in the bucket
+// of the day's start, and as their visitor hashes are gone their unique visitors are estimated from
+// the sketches; hourly buckets have no uniques for them.
+func queryTimeSeries(ctx context.Context, db *sql.DB, linkID *int, q statsQuery) (TimeSeries, error) {
+	series := TimeSeries{
+		From:                      q.From,
+		To:                        q.To,
+		Interval:                  q.Interval,
+		Timezone:                  q.Location.String(),
+		IncludeBots:               q.IncludeBots,
+		UniqueVisitorsApproximate: q.Approximate,
+		Series:                    []SeriesPoint{},
+	}
+
+	// Anonymous visits have no visitor hash, which makes the key null and leaves them out
+	uniques := "COUNT(DISTINCT created_at::date::text || ':' || visitor_hash::text)"
+	if q.Approximate {
+		uniques = "0"
+	}
+
+	// created_at holds UTC wall time, so it is first marked as UTC and then converted to local
+	// wall time for date_trunc. Local bucket starts are converted back to absolute times.
+	rows, err := db.QueryContext(ctx, `WITH buckets AS (
+			SELECT generate_series(
+				date_trunc($3, ($1::timestamp AT TIME ZONE 'UTC') AT TIME ZONE $5),
+				date_trunc($3, (($2::timestamp - interval '1 microsecond') AT TIME ZONE 'UTC') AT TIME ZONE $5),
+				('1 ' || $3)::interval
+			) AS bucket
+		), counts AS (
+			SELECT bucket, SUM(visits) AS visits, SUM(unique_visitors) AS unique_visitors
+			FROM (
+				SELECT date_trunc($3, (created_at AT TIME ZONE 'UTC') AT TIME ZONE $5) AS bucket,
+					COUNT(*) AS visits,
+					`+uniques+` AS unique_visitors
+				FROM visits
+				WHERE created_at >= $1 AND created_at < $2 AND ($4::int IS NULL OR link_id = $4)
+					AND ($6::boolean OR NOT is_bot)
+				GROUP BY 1
+				UNION ALL
+				SELECT date_trunc($3, (GREATEST(day::timestamp, $1::timestamp) AT TIME ZONE 'UTC') AT TIME ZONE $5),
+					SUM(visits),
+					0
+				FROM visit_daily_rollups
+				WHERE `+rollupDayRange+` AND ($4::int IS NULL OR link_id = $4)
+					AND ($6::boolean OR NOT is_bot)
+				GROUP BY 1
+			) c
+			GROUP BY bucket
+		)
+		SELECT b.bucket AT TIME ZONE $5, COALESCE(c.visits, 0), COALESCE(c.unique_visitors, 0)
+		FROM buckets b LEFT JOIN counts c ON c.bucket = b.bucket
+		ORDER BY b.bucket`,
+		q.From, q.To, q.Interval, linkID, q.Location.String(), q.IncludeBots)
+	if err != nil {
+		return series, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var point SeriesPoint
+		if err := rows.Scan(&point.Bucket, &point.Visits, &point.UniqueVisitors); err != nil {
+			return series, err
+		}
+		point.Bucket = point.Bucket.In(q.Location)
+		series.Series = append(series.Series, point)
+	}
+	if err := rows.Err(); err != nil {
+		return series, err
+	}
+
+	// Uniques over the whole range are not the sum of the per-bucket uniques
+	return series, queryTotals(ctx, db, linkID, q, &series)
+}
+
+// queryTotals fills the visits, unique visitors and bot visits of series over the whole range of q.
+// Uniques are estimated, along with those of the buckets of series, when q asks for it or days of
+// the range have been rolled up.
+func queryTotals(ctx context.Context, db *sql.DB, linkID *int, q statsQuery, series *TimeSeries) error {
+	// Anonymous visits have no visitor hash, which makes the key null and leaves them out
+	totalUniques := "COUNT(DISTINCT created_at::date::text || ':' || visitor_hash::text) FILTER (WHERE $4::boolean OR NOT is_bot)"
+	if q.Approximate {
+		totalUniques = "0"
+	}
+
+	var rolledUp bool
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(visits), 0), COALESCE(SUM(unique_visitors), 0),
+			COALESCE(SUM(bot_visits), 0), bool_or(rolled_up)
+		FROM (
+			SELECT COUNT(*) FILTER (WHERE $4::boolean OR NOT is_bot) AS visits,
+				`+totalUniques+` AS unique_visitors,
+				COUNT(*) FILTER (WHERE is_bot) AS bot_visits,
+				FALSE AS rolled_up
+			FROM visits
+			WHERE created_at >= $1 AND created_at < $2 AND ($3::int IS NULL OR link_id = $3)
+			UNION ALL
+			SELECT SUM(visits) FILTER (WHERE $4::boolean OR NOT is_bot),
+				0,
+				SUM(visits) FILTER (WHERE is_bot),
+				COUNT(*) > 0
+			FROM visit_daily_rollups
+			WHERE `+rollupDayRange+` AND ($3::int IS NULL OR link_id = $3)
+		) t`,
+		q.From, q.To, linkID, q.IncludeBots).Scan(&series.Visits, &series.UniqueVisitors, &series.BotVisits, &rolledUp)
+	if err != nil {
+		return err
+	}
+	if q.Approximate || rolledUp && q.Interval != "hour" {
+		series.UniqueVisitorsApproximate = true
+	}
+	if !series.UniqueVisitorsApproximate {
+		return nil
+	}
+	return estimateUniques(ctx, db, linkID, q, series)
+}
+
+// estimateUniques fills the unique visitors of series by merging the daily sketches of human
+// visitors. Each UTC day is attributed to the bucket its start falls in, and days at the edges
+// of the range are counted whole.
+func estimateUniques(ctx context.Context, db *sql.DB, linkID *int, q statsQuery, series *TimeSeries) error {
+	rows, err := db.QueryContext(ctx, `SELECT day, sketch FROM visitor_sketches
+		WHERE day >= $1::date AND day <= ($2::timestamp - interval '1 microsecond')::date
+			AND ($3::int IS NULL OR link_id = $3) AND sketch IS NOT NULL
+		ORDER BY day`, q.From, q.To, linkID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	total := visitorid.NewEstimator()
+	buckets := make([]*visitorid.Estimator, len(series.Series))
+	for rows.Next() {
+		var day time.Time
+		var data []byte
+		if err := rows.Scan(&day, &data); err != nil {
+			return err
+		}
+		// Totals without a series have no buckets to fill
+		if len(buckets) > 0 {
+			i := sort.Search(len(series.Series), func(i int) bool { return series.Series[i].Bucket.After(day) }) - 1
+			if i < 0 {
+				i = 0
+			}
+			if buckets[i] == nil {
+				buckets[i] = visitorid.NewEstimator()
+			}
+			if err := buckets[i].Add(data); err != nil {
+				return err
+			}
+		}
+		if err := total.Add(data); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, estimator := range buckets {
+		if estimator != nil {
+			series.Series[i].UniqueVisitors = estimator.Estimate()
+		}
+	}
+	series.UniqueVisitors = total.Estimate()
+	return nil
+}
+
+// linkExists writes a 400 or 404 response and reports false unless the :id parameter names an existing link
+func linkExists(c *gin.Context, db *sql.DB) (int, bool) {
+	idInt, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid link ID format"})
+		return 0, false
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(c.Request.Context(), "SELECT EXISTS(SELECT 1 FROM links WHERE id = $1)", idInt).Scan(&exists); err != nil {
+		requestLogger(c).Error("failed to query link", zap.Int("id", idInt), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query link"})
+		return 0, false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "link not found"})
+		return 0, false
+	}
+	return idInt, true
+}
+
+// HandleLinkStats returns the visit time series of one link
+func HandleLinkStats(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := parseStatsQuery(c)
+		if !ok {
+			return
+		}
+		linkID, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+
+		series, err := queryTimeSeries(c.Request.Context(), db, &linkID, q)
+		if err != nil {
+			requestLogger(c).Error("failed to query link stats", zap.Int("id", linkID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query link stats"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link stats fetched successfully", "data": series})
+	}
+}
+
+// HandleGlobalStats returns the visit time series across all links
+func HandleGlobalStats(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := parseStatsQuery(c)
+		if !ok {
+			return
+		}
+
+		series, err := queryTimeSeries(c.Request.Context(), db, nil, q)
+		if err != nil {
+			requestLogger(c).Error("failed to query global stats", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query stats"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "stats fetched successfully", "data": series})
+	}
+}
+
+// LinkSummary counts the links that exist and those created in the requested range
+type LinkSummary struct {
+	Links        int `json:"links"`
+	ActiveLinks  int `json:"active_links"`
+	CreatedLinks int `json:"created_links"`
+}
+
+// HandleLinkSummary returns the number of links, of links that have not expired and of links created
+// between from and to
+func HandleLinkSummary(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, ok := parseTimeRange(c)
+		if !ok {
+			return
+		}
+
+		var summary LinkSummary
+		err := db.QueryRowContext(c.Request.Context(), `SELECT COUNT(*),
+				COUNT(*) FILTER (WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP),
+				COUNT(*) FILTER (WHERE ($1::timestamp IS NULL OR created_at >= $1) AND ($2::timestamp IS NULL OR created_at < $2))
+			FROM links`, from, to).Scan(&summary.Links, &summary.ActiveLinks, &summary.CreatedLinks)
+		if err != nil {
+			requestLogger(c).Error("failed to query link summary", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query link summary"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link summary fetched successfully", "data": summary})
+	}
+}
+
+// TopLink is the visit count of one link over the requested range
+type TopLink struct {
+	ID     int    `json:"id"`
+	Code   string `json:"code"`
+	URL    string `json:"url"`
+	Visits int    `json:"visits"`
+}
+
+// HandleTopLinks returns the links with the most visits between from and to, raw and rolled up
+func HandleTopLinks(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		limit, ok := parseBreakdownLimit(c)
+		if !ok {
+			return
+		}
+		from, to, ok := parseTimeRange(c)
+		if !ok {
+			return
+		}
+		includeBots, ok := parseIncludeBots(c)
+		if !ok {
+			return
+		}
+
+		rows, err := db.QueryContext(c.Request.Context(), `SELECT l.id, l.code, l.url, SUM(v.visits)
+			FROM (
+				SELECT link_id, COUNT(*) AS visits
+				FROM visits
+				WHERE ($1::timestamp IS NULL OR created_at >= $1)
+					AND ($2::timestamp IS NULL OR created_at < $2)
+					AND ($3::boolean OR NOT is_bot)
+				GROUP BY link_id
+				UNION ALL
+				SELECT link_id, SUM(visits)
+				FROM visit_daily_rollups
+				WHERE `+rollupDayRange+`
+					AND ($3::boolean OR NOT is_bot)
+				GROUP BY link_id
+			) v
+			JOIN links l ON l.id = v.link_id
+			GROUP BY l.id
+			ORDER BY SUM(v.visits) DESC, l.id
+			LIMIT $4`, from, to, includeBots, limit)
+		if err != nil {
+			logger.Error("failed to query top links", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query top links"})
+			return
+		}
+		defer rows.Close()
+
+		links := []TopLink{}
+		for rows.Next() {
+			var link TopLink
+			if err := rows.Scan(&link.ID, &link.Code, &link.URL, &link.Visits); err != nil {
+				logger.Error("failed to scan top link row", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan top link row"})
+				return
+			}
+			links = append(links, link)
+		}
+		if err = rows.Err(); err != nil {
+			logger.Error("error iterating top link rows", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "error reading top links"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "top links fetched successfully", "data": links})
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"shurl/src/visitfeed"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// streamRetry is the reconnection delay suggested to EventSource clients
+const streamRetry = 3 * time.Second
+
+// HandleLinkVisitStream streams the visits of one link as Server-Sent Events
+func HandleLinkVisitStream(db *sql.DB, feed *visitfeed.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		linkID, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+		streamVisits(c, feed, &linkID)
+	}
+}
+
+// HandleVisitStream streams the visits of all links as Server-Sent Events
+func HandleVisitStream(feed *visitfeed.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		streamVisits(c, feed, nil)
+	}
+}
+
+// streamVisits sends each visit as a "visit" event whose id is the event id and whose data is the
+// visitfeed.Event as JSON. A client reconnecting with Last-Event-ID, or the last_event_id query
+// parameter, first receives the buffered visits it missed. Idle streams get a comment every
+// heartbeat so proxies keep them open.
+func streamVisits(c *gin.Context, feed *visitfeed.Hub, linkID *int) {
+	includeBots, ok := parseIncludeBots(c)
+	if !ok {
+		return
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	// An unparseable id resumes nothing rather than failing the reconnect
+	after, _ := strconv.ParseInt(lastEventID, 10, 64)
+
+	sub, backlog := feed.Subscribe(linkID, includeBots, after)
+	defer sub.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Keeps nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Render(-1, sse.Event{Event: "ready", Retry: uint(streamRetry.Milliseconds()), Data: "ok"})
+	for _, ev := range backlog {
+		renderVisitEvent(c, ev)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(feed.Heartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			renderVisitEvent(c, ev)
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": heartbeat\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+func renderVisitEvent(c *gin.Context, ev visitfeed.Event) {
+	c.Render(-1, sse.Event{Id: strconv.FormatInt(ev.ID, 10), Event: "visit", Data: ev})
+}
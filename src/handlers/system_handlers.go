@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"net/http"
+	"shurl/src/anomaly"
+	"shurl/src/geoip"
+	"shurl/src/linkcache"
+	"shurl/src/recorder"
+	"shurl/src/retention"
+	"shurl/src/visitfeed"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleSystemStats reports the internal state of the background pipelines
+func HandleSystemStats(rec *recorder.Recorder, cache *linkcache.Cache, geo *geoip.Enricher, rollups *retention.Scheduler, feed *visitfeed.Hub, anomalies *anomaly.Detector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": "system stats fetched successfully",
+			"data": gin.H{
+				"visit_recorder": rec.Stats(),
+				"link_cache":     cache.Stats(),
+				"geoip":          geo.Stats(),
+				"visit_rollups":  rollups.Stats(),
+				"visit_stream":   feed.Stats(),
+				"anomalies":      anomalies.Stats(),
+			},
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net/http"
+	"shurl/src/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// defaultComparisonPeriod is the period compared with the one before it when from is not given
+const defaultComparisonPeriod = 7 * 24 * time.Hour
+
+// defaultTrendingMinVisits is the fewest visits a link needs in the period to be trending, so that
+// a link going from one visit to three does not top the list
+const defaultTrendingMinVisits = 10
+
+// PeriodTotals are the visit counts of one period of a comparison
+type PeriodTotals struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	Visits         int       `json:"visits"`
+	UniqueVisitors int       `json:"unique_visitors"`
+	// UniqueVisitorsApproximate is set when uniques are HyperLogLog estimates
+	UniqueVisitorsApproximate bool `json:"unique_visitors_approximate"`
+}
+
+// Comparison compares the visits of a period with the period of the same length just before it
+type Comparison struct {
+	Current  PeriodTotals `json:"current"`
+	Previous PeriodTotals `json:"previous"`
+	// VisitsChange and UniqueVisitorsChange are relative changes in percent, null when the previous
+	// period had nothing to compare with
+	VisitsChange         *float64 `json:"visits_change"`
+	UniqueVisitorsChange *float64 `json:"unique_visitors_change"`
+}
+
+// TrendingLink is a link whose visits grew from the previous period to the current one
+type TrendingLink struct {
+	ID             int    `json:"id"`
+	Code           string `json:"code"`
+	URL            string `json:"url"`
+	Visits         int    `json:"visits"`
+	PreviousVisits int    `json:"previous_visits"`
+	// Change is the relative change in percent, null for links without visits in the previous period
+	Change *float64 `json:"change"`
+	// Spikes and Drops count the anomalies flagged for the link during the current period
+	Spikes int `json:"spikes"`
+	Drops  int `json:"drops"`
+}
+
+// percentChange is the change from previous to current in percent, rounded to one decimal, or nil
+// when previous is zero
+func percentChange(current, previous int) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	change := math.Round(float64(current-previous)/float64(previous)*1000) / 10
+	return &change
+}
+
+// parseComparisonQuery reads the current period from from, to and include_bots, writing the error
+// response on failure. The period defaults to the 7 days before now; the previous period is the one
+// of the same length ending where the current one starts.
+func parseComparisonQuery(c *gin.Context) (current, previous statsQuery, ok bool) {
+	includeBots, ok := parseIncludeBots(c)
+	if !ok {
+		return current, previous, false
+	}
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return current, previous, false
+	}
+
+	current = statsQuery{Interval: "day", Location: time.UTC, IncludeBots: includeBots, To: time.Now().UTC()}
+	if to != nil {
+		current.To = *to
+	}
+	current.From = current.To.Add(-defaultComparisonPeriod)
+	if from != nil {
+		current.From = *from
+	}
+	if !current.From.Before(current.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "from must be before to"})
+		return current, previous, false
+	}
+	current.Approximate = current.To.Sub(current.From) > exactUniquesMaxRange
+
+	previous = current
+	previous.From, previous.To = current.From.Add(-current.To.Sub(current.From)), current.From
+	return current, previous, true
+}
+
+// queryComparison counts the visits of both periods for one link, or for all links when linkID is nil
+func queryComparison(ctx context.Context, db *sql.DB, linkID *int, current, previous statsQuery) (Comparison, error) {
+	var comparison Comparison
+	for _, period := range []struct {
+		q      statsQuery
+		totals *PeriodTotals
+	}{{current, &comparison.Current}, {previous, &comparison.Previous}} {
+		series := TimeSeries{}
+		if err := queryTotals(ctx, db, linkID, period.q, &series); err != nil {
+			return comparison, err
+		}
+		*period.totals = PeriodTotals{
+			From:                      period.q.From,
+			To:                        period.q.To,
+			Visits:                    series.Visits,
+			UniqueVisitors:            series.UniqueVisitors,
+			UniqueVisitorsApproximate: series.UniqueVisitorsApproximate,
+		}
+	}
+	comparison.VisitsChange = percentChange(comparison.Current.Visits, comparison.Previous.Visits)
+	comparison.UniqueVisitorsChange = percentChange(comparison.Current.UniqueVisitors, comparison.Previous.UniqueVisitors)
+	return comparison, nil
+}
+
+// HandleLinkComparison compares a link's visits in a period with the period before it
+func HandleLinkComparison(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		current, previous, ok := parseComparisonQuery(c)
+		if !ok {
+			return
+		}
+		id, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+
+		comparison, err := queryComparison(c.Request.Context(), db, &id, current, previous)
+		if err != nil {
+			requestLogger(c).Error("failed to query link comparison", zap.Int("id", id), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query comparison"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "link comparison fetched successfully", "data": comparison})
+	}
+}
+
+// HandleComparison compares the visits of all links in a period with the period before it
+func HandleComparison(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		current, previous, ok := parseComparisonQuery(c)
+		if !ok {
+			return
+		}
+
+		comparison, err := queryComparison(c.Request.Context(), db, nil, current, previous)
+		if err != nil {
+			requestLogger(c).Error("failed to query comparison", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query comparison"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "comparison fetched successfully", "data": comparison})
+	}
+}
+
+// HandleTrendingLinks returns the links whose visits grew the most, relative to the previous period,
+// among those with at least min_visits visits in the current period
+func HandleTrendingLinks(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		limit, ok := parseBreakdownLimit(c)
+		if !ok {
+			return
+		}
+		current, previous, ok := parseComparisonQuery(c)
+		if !ok {
+			return
+		}
+		minVisits := defaultTrendingMinVisits
+		if raw := c.Query("min_visits"); raw != "" {
+			var err error
+			if minVisits, err = strconv.Atoi(raw); err != nil || minVisits < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "min_visits must be a positive number"})
+				return
+			}
+		}
+
+		// Rolled-up days belong to the period their start falls in
+		rows, err := db.QueryContext(c.Request.Context(), `SELECT l.id, l.code, l.url, SUM(t.current), SUM(t.previous),
+				(SELECT COUNT(*) FROM link_anomalies a
+					WHERE a.link_id = l.id AND a.kind = 'spike' AND a.bucket >= $2 AND a.bucket < $3),
+				(SELECT COUNT(*) FROM link_anomalies a
+					WHERE a.link_id = l.id AND a.kind = 'drop' AND a.bucket >= $2 AND a.bucket < $3)
+			FROM (
+				SELECT link_id,
+					COUNT(*) FILTER (WHERE created_at >= $2) AS current,
+					COUNT(*) FILTER (WHERE created_at < $2) AS previous
+				FROM visits
+				WHERE created_at >= $1 AND created_at < $3 AND ($4::boolean OR NOT is_bot)
+				GROUP BY link_id
+				UNION ALL
+				SELECT link_id,
+					COALESCE(SUM(visits) FILTER (WHERE day >= $2::date), 0),
+					COALESCE(SUM(visits) FILTER (WHERE day < $2::date), 0)
+				FROM visit_daily_rollups
+				WHERE day >= $1::date AND day < $3::timestamp AND ($4::boolean OR NOT is_bot)
+				GROUP BY link_id
+			) t
+			JOIN links l ON l.id = t.link_id
+			GROUP BY l.id
+			HAVING SUM(t.current) >= $5 AND SUM(t.current) > SUM(t.previous)
+			ORDER BY (SUM(t.current) - SUM(t.previous))::float / GREATEST(SUM(t.previous), 1) DESC, SUM(t.current) DESC, l.id
+			LIMIT $6`, previous.From, current.From, current.To, current.IncludeBots, minVisits, limit)
+		if err != nil {
+			logger.Error("failed to query trending links", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query trending links"})
+			return
+		}
+		defer rows.Close()
+
+		links := []TrendingLink{}
+		for rows.Next() {
+			var link TrendingLink
+			if err := rows.Scan(&link.ID, &link.Code, &link.URL, &link.Visits, &link.PreviousVisits, &link.Spikes, &link.Drops); err != nil {
+				logger.Error("failed to scan trending link row", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan trending link row"})
+				return
+			}
+			link.Change = percentChange(link.Visits, link.PreviousVisits)
+			links = append(links, link)
+		}
+		if err = rows.Err(); err != nil {
+			logger.Error("error iterating trending link rows", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "error reading trending links"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "trending links fetched successfully", "data": links})
+	}
+}
+
+// HandleLinkAnomalies returns the spikes and drops flagged for a link, newest first
+func HandleLinkAnomalies(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeAnomalies(c, db, true)
+	}
+}
+
+// HandleAnomalies returns the spikes and drops flagged for all links, newest first
+func HandleAnomalies(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writeAnomalies(c, db, false)
+	}
+}
+
+// writeAnomalies responds with the anomalies of the hours between from and to, of the kind given
+// by the kind parameter when set, for the link named by the :id parameter when perLink is set
+func writeAnomalies(c *gin.Context, db *sql.DB, perLink bool) {
+	logger := requestLogger(c)
+	limit, ok := parseBreakdownLimit(c)
+	if !ok {
+		return
+	}
+	from, to, ok := parseTimeRange(c)
+	if !ok {
+		return
+	}
+	var kind *string
+	if raw := c.Query("kind"); raw != "" {
+		if raw != "spike" && raw != "drop" {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "kind must be spike or drop"})
+			return
+		}
+		kind = &raw
+	}
+	var linkID *int
+	if perLink {
+		id, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+		linkID = &id
+	}
+
+	rows, err := db.QueryContext(c.Request.Context(), `SELECT a.id, a.link_id, l.code, a.kind, a.bucket, a.visits, a.baseline, a.score, a.created_at
+		FROM link_anomalies a
+		JOIN links l ON l.id = a.link_id
+		WHERE ($1::int IS NULL OR a.link_id = $1)
+			AND ($2::timestamp IS NULL OR a.bucket >= $2)
+			AND ($3::timestamp IS NULL OR a.bucket < $3)
+			AND ($4::text IS NULL OR a.kind = $4)
+		ORDER BY a.bucket DESC, a.id DESC
+		LIMIT $5`, linkID, from, to, kind, limit)
+	if err != nil {
+		logger.Error("failed to query link anomalies", zap.Any("id", linkID), zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query anomalies"})
+		return
+	}
+	defer rows.Close()
+
+	anomalies := []models.Anomaly{}
+	for rows.Next() {
+		var a models.Anomaly
+		if err := rows.Scan(&a.ID, &a.LinkID, &a.Code, &a.Kind, &a.Bucket, &a.Visits, &a.Baseline, &a.Score, &a.CreatedAt); err != nil {
+			logger.Error("failed to scan link anomaly row", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan anomaly row"})
+			return
+		}
+		anomalies = append(anomalies, a)
+	}
+	if err = rows.Err(); err != nil {
+		logger.Error("error iterating link anomaly rows", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "error reading anomalies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "message": "anomalies fetched successfully", "data": anomalies})
+}
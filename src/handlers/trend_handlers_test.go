@@ -0,0 +1,38 @@
+package handlers
+
+import "testing"
+
+func TestPercentChange(t *testing.T) {
+	tests := []struct {
+		current, previous int
+		want              *float64
+	}{
+		{10, 0, nil},
+		{0, 0, nil},
+		{150, 100, floatPtr(50.0)},
+		{50, 100, floatPtr(-50.0)},
+		{0, 40, floatPtr(-100.0)},
+		{100, 100, floatPtr(0.0)},
+		{2, 3, floatPtr(-33.3)},
+		{5, 3, floatPtr(66.7)},
+	}
+	for _, tt := range tests {
+		got := percentChange(tt.current, tt.previous)
+		switch {
+		case got == nil && tt.want == nil:
+		case got == nil || tt.want == nil || *got != *tt.want:
+			t.Errorf("percentChange(%d, %d) = %v, want %v", tt.current, tt.previous, floatOrNil(got), floatOrNil(tt.want))
+		}
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func floatOrNil(f *float64) any {
+	if f == nil {
+		return nil
+	}
+	return *f
+}
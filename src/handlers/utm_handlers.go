@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"shurl/src/models"
+	"shurl/src/validation"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// utmPresetColumns is the column list scanned by scanUTMPreset
+const utmPresetColumns = "id, name, utm_source, utm_medium, utm_campaign, utm_term, utm_content, created_at, updated_at"
+
+// scanUTMPreset scans a row selected with utmPresetColumns into preset
+func scanUTMPreset(row rowScanner, preset *models.UTMPreset) error {
+	return row.Scan(
+		&preset.ID, &preset.Name, &preset.UTMSource, &preset.UTMMedium, &preset.UTMCampaign,
+		&preset.UTMTerm, &preset.UTMContent, &preset.CreatedAt, &preset.UpdatedAt,
+	)
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// applyUTMPreset fills the UTM fields left unset in utm from a preset, writing the error response on failure
+func applyUTMPreset(c *gin.Context, db *sql.DB, presetID int, utm *models.UTM) bool {
+	var preset models.UTMPreset
+	err := scanUTMPreset(db.QueryRowContext(c.Request.Context(), "SELECT "+utmPresetColumns+" FROM utm_presets WHERE id = $1", presetID), &preset)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "utm preset not found"})
+		} else {
+			requestLogger(c).Error("failed to query utm preset", zap.Int("id", presetID), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query utm preset"})
+		}
+		return false
+	}
+	utm.Merge(preset.UTM)
+	return true
+}
+
+// HandleListUTMPresets returns all UTM presets ordered by name
+func HandleListUTMPresets(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		rows, err := db.QueryContext(c.Request.Context(), "SELECT "+utmPresetColumns+" FROM utm_presets ORDER BY name")
+		if err != nil {
+			logger.Error("failed to query utm presets", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query utm presets"})
+			return
+		}
+		defer rows.Close()
+
+		presets := []models.UTMPreset{}
+		for rows.Next() {
+			var preset models.UTMPreset
+			if err := scanUTMPreset(rows, &preset); err != nil {
+				logger.Error("failed to scan utm preset row", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan utm preset row"})
+				return
+			}
+			presets = append(presets, preset)
+		}
+		if err = rows.Err(); err != nil {
+			logger.Error("error iterating utm preset rows", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "error reading utm presets"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "utm presets fetched successfully", "data": presets})
+	}
+}
+
+// HandleCreateUTMPreset creates a named UTM preset
+func HandleCreateUTMPreset(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		var input models.InputUTMPreset
+		if err := c.ShouldBindJSON(&input); err != nil {
+			logger.Error("failed to bind utm preset", zap.Error(err))
+			validation.HandleValidationErrors(c, err, input)
+			return
+		}
+
+		var preset models.UTMPreset
+		sqlStatement := `INSERT INTO utm_presets (name, utm_source, utm_medium, utm_campaign, utm_term, utm_content)
+			VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, '')) RETURNING ` + utmPresetColumns
+		err := scanUTMPreset(db.QueryRowContext(c.Request.Context(), sqlStatement, input.Name,
+			input.UTMSource, input.UTMMedium, input.UTMCampaign, input.UTMTerm, input.UTMContent), &preset)
+		if err != nil {
+			if isUniqueViolation(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "utm preset name already exists"})
+				return
+			}
+			logger.Error("failed to insert utm preset", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to insert utm preset"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"status": "success", "message": "utm preset created successfully", "data": preset})
+	}
+}
+
+// HandleUpdateUTMPreset replaces the name and parameters of a UTM preset. Links created from the
+// preset keep the values they were created with.
+func HandleUpdateUTMPreset(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logger := requestLogger(c)
+		idInt, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid utm preset ID format"})
+			return
+		}
+
+		var input models.InputUTMPreset
+		if err := c.ShouldBindJSON(&input); err != nil {
+			logger.Error("failed to bind utm preset", zap.Error(err))
+			validation.HandleValidationErrors(c, err, input)
+			return
+		}
+
+		var preset models.UTMPreset
+		sqlStatement := `UPDATE utm_presets SET name = $1, utm_source = NULLIF($2, ''), utm_medium = NULLIF($3, ''),
+			utm_campaign = NULLIF($4, ''), utm_term = NULLIF($5, ''), utm_content = NULLIF($6, ''),
+			updated_at = CURRENT_TIMESTAMP
+			WHERE id = $7 RETURNING ` + utmPresetColumns
+		err = scanUTMPreset(db.QueryRowContext(c.Request.Context(), sqlStatement, input.Name,
+			input.UTMSource, input.UTMMedium, input.UTMCampaign, input.UTMTerm, input.UTMContent, idInt), &preset)
+		if err != nil {
+			switch {
+			case err == sql.ErrNoRows:
+				c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "utm preset not found"})
+			case isUniqueViolation(err):
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "utm preset name already exists"})
+			default:
+				logger.Error("failed to update utm preset", zap.Int("id", idInt), zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to update utm preset"})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "utm preset updated successfully", "data": preset})
+	}
+}
+
+// HandleDeleteUTMPreset deletes a UTM preset
+func HandleDeleteUTMPreset(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idInt, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid utm preset ID format"})
+			return
+		}
+
+		result, err := db.ExecContext(c.Request.Context(), "DELETE FROM utm_presets WHERE id = $1", idInt)
+		if err != nil {
+			requestLogger(c).Error("failed to delete utm preset", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to delete utm preset"})
+			return
+		}
+
+		rowsAffected, _ := result.RowsAffected()
+		if rowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "message": "utm preset not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "utm preset deleted successfully"})
+	}
+}
@@ -2,36 +2,127 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
 	"shurl/src/models"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
-// HandleLinkVisits returns the visits for a specific link
+// visitColumns is the column list scanned by scanVisit
+const visitColumns = `id, link_id, COALESCE(ip_address, ''), ip_mode, COALESCE(user_agent, ''), COALESCE(referrer, ''),
+	source, anonymous, created_at, updated_at,
+	browser, browser_version, os, os_version, device_type, bot_name,
+	country, region, city, asn, as_org,
+	referrer_host, referrer_class, utm_source, utm_medium, utm_campaign, utm_term, utm_content,
+	is_bot`
+
+// scanVisit scans a row selected with visitColumns into visit
+func scanVisit(row rowScanner, visit *models.Visit) error {
+	return row.Scan(
+		&visit.ID, &visit.LinkID, &visit.IPAddress, &visit.IPMode, &visit.UserAgent, &visit.Referrer,
+		&visit.Source, &visit.Anonymous, &visit.CreatedAt, &visit.UpdatedAt,
+		&visit.Browser, &visit.BrowserVersion, &visit.OS, &visit.OSVersion, &visit.DeviceType, &visit.BotName,
+		&visit.Country, &visit.Region, &visit.City, &visit.ASN, &visit.ASOrg,
+		&visit.ReferrerHost, &visit.ReferrerClass,
+		&visit.UTMSource, &visit.UTMMedium, &visit.UTMCampaign, &visit.UTMTerm, &visit.UTMContent,
+		&visit.IsBot,
+	)
+}
+
+const (
+	defaultVisitsPerPage = 50
+	maxVisitsPerPage     = 500
+)
+
+// parseVisitPage reads the page and per_page query parameters, writing a 400 response when they are invalid
+func parseVisitPage(c *gin.Context) (page, perPage int, ok bool) {
+	page, perPage = 1, defaultVisitsPerPage
+	var err error
+	if raw := c.Query("page"); raw != "" {
+		if page, err = strconv.Atoi(raw); err != nil || page < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "page must be a positive number"})
+			return 0, 0, false
+		}
+	}
+	if raw := c.Query("per_page"); raw != "" {
+		if perPage, err = strconv.Atoi(raw); err != nil || perPage < 1 || perPage > maxVisitsPerPage {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "per_page must be between 1 and " + strconv.Itoa(maxVisitsPerPage)})
+			return 0, 0, false
+		}
+	}
+	return page, perPage, true
+}
+
+// visitFilters turns the breakdown dimensions present in the query string into conditions on
+// visits, numbering their arguments from next. A value matches the visits a breakdown lists it
+// for, so filtering by "Unknown" selects the visits without a value.
+func visitFilters(c *gin.Context, next int) (string, []any) {
+	dimensions := make([]string, 0, len(breakdownDimensions))
+	for dimension := range breakdownDimensions {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+
+	var conditions strings.Builder
+	var args []any
+	for _, dimension := range dimensions {
+		value, ok := c.GetQuery(dimension)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&conditions, " AND COALESCE(%s, 'Unknown') = $%d", breakdownDimensions[dimension], next+len(args))
+		args = append(args, value)
+	}
+	return conditions.String(), args
+}
+
+// HandleLinkVisits returns one page of a link's visits, newest first. Visits can be narrowed to a
+// time range and to values of the breakdown dimensions, and bots are left out unless include_bots is set.
 func HandleLinkVisits(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := c.Param("id")
-		_, err := strconv.Atoi(id)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "message": "invalid link ID format"})
+		logger := requestLogger(c)
+		id, ok := linkExists(c, db)
+		if !ok {
+			return
+		}
+		page, perPage, ok := parseVisitPage(c)
+		if !ok {
+			return
+		}
+		from, to, ok := parseTimeRange(c)
+		if !ok {
+			return
+		}
+		includeBots, ok := parseIncludeBots(c)
+		if !ok {
 			return
 		}
 
-		rows, err := db.Query("SELECT id, link_id, ip_address, user_agent, referrer, created_at, updated_at FROM visits WHERE link_id = $1 ORDER BY created_at DESC", id)
+		filters, filterArgs := visitFilters(c, 7)
+		// One visit more than the page is fetched to tell whether another page follows
+		args := append([]any{id, includeBots, from, to, perPage + 1, (page - 1) * perPage}, filterArgs...)
+		rows, err := db.QueryContext(c.Request.Context(), `SELECT `+visitColumns+` FROM visits
+			WHERE link_id = $1 AND ($2::boolean OR NOT is_bot)
+				AND ($3::timestamp IS NULL OR created_at >= $3)
+				AND ($4::timestamp IS NULL OR created_at < $4)`+filters+`
+			ORDER BY created_at DESC, id DESC
+			LIMIT $5 OFFSET $6`, args...)
 		if err != nil {
-			logger.Error("failed to query visit rows", zap.Error(err))
+			logger.Error("failed to query visit rows", zap.Int("id", id), zap.Error(err))
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to query visits"})
 			return
 		}
 		defer rows.Close()
 
-		var visits []models.Visit
+		visits := []models.Visit{}
 		for rows.Next() {
 			var visit models.Visit
-			err = rows.Scan(&visit.ID, &visit.LinkID, &visit.IPAddress, &visit.UserAgent, &visit.Referrer, &visit.CreatedAt, &visit.UpdatedAt)
+			err = scanVisit(rows, &visit)
 			if err != nil {
 				logger.Error("failed to scan visit row", zap.Error(err))
 				c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed to scan visit row"})
@@ -44,6 +135,16 @@ func HandleLinkVisits(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "error reading visits"})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"status": "success", "message": "visits fetched successfully", "data": visits})
+
+		hasMore := len(visits) > perPage
+		if hasMore {
+			visits = visits[:perPage]
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":     "success",
+			"message":    "visits fetched successfully",
+			"data":       visits,
+			"pagination": gin.H{"page": page, "per_page": perPage, "has_more": hasMore},
+		})
 	}
 }
@@ -0,0 +1,155 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"shurl/src/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AnomalyChannel is the Postgres NOTIFY channel each new anomaly is published on as JSON, for
+// notifications to LISTEN to
+const AnomalyChannel = "link_anomalies"
+
+// minBaselineHours is the shortest history a link needs before its hours are checked, so that the
+// first visits of a new link are not all flagged as a spike
+const minBaselineHours = 24
+
+// AnomalyRule decides which hours of a link are anomalous
+type AnomalyRule struct {
+	// Baseline is the period before an hour its visits are compared with
+	Baseline time.Duration
+	// Threshold is how many standard deviations from the baseline mean an hour must be
+	Threshold float64
+	// MinVisits is the fewest visits a spike must have, and the lowest baseline mean a drop is flagged from
+	MinVisits int
+}
+
+// Classify compares the visits of an hour with the mean and standard deviation of the baseline
+// hours. It returns spike or drop with the score of the hour, or an empty kind when the hour is
+// within the baseline. The deviation is at least that of a Poisson process with the same mean, so
+// links with steady but sparse visits are not flagged for small changes.
+func (r AnomalyRule) Classify(visits int, mean, stddev float64) (string, float64) {
+	sigma := math.Max(math.Max(stddev, math.Sqrt(mean)), 1)
+	score := (float64(visits) - mean) / sigma
+	switch {
+	case score >= r.Threshold && visits >= r.MinVisits:
+		return "spike", score
+	case score <= -r.Threshold && mean >= float64(r.MinVisits):
+		return "drop", score
+	}
+	return "", score
+}
+
+// DetectAnomalies compares the human visits of every link in the hour starting at hour with each
+// hour of the baseline before it, and stores and publishes the anomalies found. Links without visits
+// in the baseline or the hour are not checked. Days rolled up into daily counts have no hours, so the
+// baseline is shortened to start after them, and hours of a rolled-up day are not checked at all. An
+// hour is only flagged once, so it can be checked again by reruns and other replicas; the anomalies
+// returned are the new ones.
+func DetectAnomalies(ctx context.Context, db *sql.DB, logger *zap.Logger, rule AnomalyRule, hour time.Time) ([]models.Anomaly, error) {
+	hour = hour.UTC().Truncate(time.Hour)
+	start := hour.Add(-rule.Baseline)
+
+	// Counting the hours of rolled-up days as empty would lower the mean and flag false spikes
+	var rolledUp sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT MAX(day) FROM visit_daily_rollups WHERE day <= $1::date`, hour).Scan(&rolledUp)
+	if err != nil {
+		return nil, err
+	}
+	if rolledUp.Valid {
+		after := time.Date(rolledUp.Time.Year(), rolledUp.Time.Month(), rolledUp.Time.Day()+1, 0, 0, 0, 0, time.UTC)
+		if after.After(hour) {
+			return nil, nil
+		}
+		if after.After(start) {
+			start = after
+		}
+	}
+
+	// Hours without visits count as zero, so the baseline is computed from sums rather than rows
+	rows, err := db.QueryContext(ctx, `SELECT h.link_id, l.code, l.created_at,
+			COALESCE(SUM(h.visits) FILTER (WHERE h.hour = $2), 0),
+			COALESCE(SUM(h.visits) FILTER (WHERE h.hour < $2), 0),
+			COALESCE(SUM(h.visits * h.visits) FILTER (WHERE h.hour < $2), 0)
+		FROM (
+			SELECT link_id, date_trunc('hour', created_at) AS hour, COUNT(*) AS visits
+			FROM visits
+			WHERE created_at >= $1 AND created_at < $2::timestamp + interval '1 hour' AND NOT is_bot
+			GROUP BY 1, 2
+		) h
+		JOIN links l ON l.id = h.link_id
+		GROUP BY h.link_id, l.code, l.created_at`, start, hour)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []models.Anomaly
+	for rows.Next() {
+		var (
+			anomaly   models.Anomaly
+			createdAt time.Time
+			sum, sq   float64
+		)
+		if err := rows.Scan(&anomaly.LinkID, &anomaly.Code, &createdAt, &anomaly.Visits, &sum, &sq); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		// Only the hours since the link was created are part of its baseline
+		from := start
+		if created := createdAt.UTC().Truncate(time.Hour); created.After(from) {
+			from = created
+		}
+		hours := hour.Sub(from).Hours()
+		if hours < minBaselineHours {
+			continue
+		}
+		mean := sum / hours
+		stddev := math.Sqrt(math.Max(sq/hours-mean*mean, 0))
+
+		anomaly.Kind, anomaly.Score = rule.Classify(anomaly.Visits, mean, stddev)
+		if anomaly.Kind == "" {
+			continue
+		}
+		anomaly.Bucket, anomaly.Baseline = hour, mean
+		candidates = append(candidates, anomaly)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var flagged []models.Anomaly
+	for _, anomaly := range candidates {
+		err := db.QueryRowContext(ctx, `INSERT INTO link_anomalies (link_id, kind, bucket, visits, baseline, score)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (link_id, bucket) DO NOTHING
+			RETURNING id, created_at`,
+			anomaly.LinkID, anomaly.Kind, anomaly.Bucket, anomaly.Visits, anomaly.Baseline, anomaly.Score,
+		).Scan(&anomaly.ID, &anomaly.CreatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return flagged, err
+		}
+		flagged = append(flagged, anomaly)
+		logger.Info("link anomaly detected", zap.Int("link_id", anomaly.LinkID), zap.String("kind", anomaly.Kind),
+			zap.Time("hour", anomaly.Bucket), zap.Int("visits", anomaly.Visits), zap.Float64("baseline", anomaly.Baseline))
+
+		// The anomaly is stored either way; a failed notification is only logged
+		payload, err := json.Marshal(anomaly)
+		if err == nil {
+			_, err = db.ExecContext(ctx, "SELECT pg_notify($1, $2)", AnomalyChannel, string(payload))
+		}
+		if err != nil {
+			logger.Error("failed to publish link anomaly", zap.Int("id", anomaly.ID), zap.Error(err))
+		}
+	}
+	return flagged, nil
+}
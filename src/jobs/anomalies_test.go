@@ -0,0 +1,34 @@
+package jobs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAnomalyRuleClassify(t *testing.T) {
+	rule := AnomalyRule{Threshold: 3, MinVisits: 20}
+	tests := []struct {
+		name         string
+		visits       int
+		mean, stddev float64
+		wantKind     string
+		wantScore    float64
+	}{
+		{"spike", 40, 10, 2, "spike", 30 / math.Sqrt(10)},
+		{"spike from an empty baseline", 25, 0, 0, "spike", 25},
+		{"spike below min visits", 15, 2, 0.5, "", 13 / math.Sqrt(2)},
+		{"drop", 50, 100, 10, "drop", -5},
+		{"drop from a low baseline", 0, 10, 1, "", -10 / math.Sqrt(10)},
+		{"within the baseline", 120, 100, 10, "", 2},
+		{"steady link within poisson noise", 65, 50, 0, "", 15 / math.Sqrt(50)},
+		{"on the threshold", 50, 20, 10, "spike", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, score := rule.Classify(tt.visits, tt.mean, tt.stddev)
+			if kind != tt.wantKind || math.Abs(score-tt.wantScore) > 1e-9 {
+				t.Errorf("Classify(%d, %v, %v) = %q, %v, want %q, %v", tt.visits, tt.mean, tt.stddev, kind, score, tt.wantKind, tt.wantScore)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/privacy"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// AnonymizeIPs converts the stored IP addresses of visits recorded under a less private mode to the
+// mode of opts, so tightening IP_PRIVACY_MODE also covers past visits. Addresses can only become more
+// private; visits already stored under a more private mode are left alone. It returns the number of
+// visits updated.
+func AnonymizeIPs(ctx context.Context, db *sql.DB, logger *zap.Logger, opts privacy.Options, batchSize int) (int, error) {
+	from := opts.Mode.LessPrivate()
+	if len(from) == 0 {
+		return 0, nil
+	}
+	modes := make([]string, len(from))
+	for i, mode := range from {
+		modes[i] = string(mode)
+	}
+	return backfill(ctx, db, logger, "anonymize-ips", batchSize,
+		func(ctx context.Context, db *sql.DB, afterID, batchSize int) (int, int, error) {
+			return anonymizeIPBatch(ctx, db, opts, modes, afterID, batchSize)
+		})
+}
+
+func anonymizeIPBatch(ctx context.Context, db *sql.DB, opts privacy.Options, modes []string, afterID, batchSize int) (int, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, COALESCE(ip_address, ''), ip_mode FROM visits
+		WHERE ip_mode = ANY($1::text[]) AND id > $2
+		ORDER BY id
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED`, pq.Array(modes), afterID, batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		ids []int64
+		ips []sql.NullString
+	)
+	for rows.Next() {
+		var id int64
+		var ip, mode string
+		if err := rows.Scan(&id, &ip, &mode); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		anonymized, _ := opts.Anonymize(ip, privacy.Mode(mode))
+		ids = append(ids, id)
+		ips = append(ips, nullString(anonymized))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, afterID, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE visits SET ip_address = u.ip, ip_mode = $3
+		FROM (SELECT unnest($1::bigint[]) AS id, unnest($2::text[]) AS ip) u
+		WHERE visits.id = u.id`,
+		pq.Array(ids), pq.Array(ips), string(opts.Mode))
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(ids), int(ids[len(ids)-1]), nil
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+
+	"go.uber.org/zap"
+)
+
+// batchFunc updates up to batchSize pending visits with an id above afterID and returns how many
+// were updated along with the highest id seen
+type batchFunc func(ctx context.Context, db *sql.DB, afterID, batchSize int) (int, int, error)
+
+// backfill runs batch until no pending visits remain. Rows are processed in id order, each batch in
+// its own transaction, so a backfill can be interrupted and re-run at any time: it picks up the rows
+// that are still pending. It returns the number of visits updated.
+func backfill(ctx context.Context, db *sql.DB, logger *zap.Logger, name string, batchSize int, batch batchFunc) (int, error) {
+	total := 0
+	lastID := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		n, next, err := batch(ctx, db, lastID, batchSize)
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+		total += n
+		lastID = next
+		logger.Info("backfilled visits", zap.String("backfill", name), zap.Int("batch", n), zap.Int("total", total), zap.Int("lastId", lastID))
+	}
+}
+
+// nullString stores empty parser results as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// truncate cuts s to n characters to fit a VARCHAR(n) column
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
@@ -0,0 +1,74 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/referrer"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// BackfillReferrers parses the referrer host and source class of every visit recorded before
+// referrers were classified at record time. The request host and utm_medium of those visits were
+// not kept, so they are classified on their referrer and the configured internal hosts alone.
+// It returns the number of visits updated.
+func BackfillReferrers(ctx context.Context, db *sql.DB, logger *zap.Logger, classifier *referrer.Classifier, batchSize int) (int, error) {
+	return backfill(ctx, db, logger, "referrers", batchSize,
+		func(ctx context.Context, db *sql.DB, afterID, batchSize int) (int, int, error) {
+			return backfillReferrerBatch(ctx, db, classifier, afterID, batchSize)
+		})
+}
+
+func backfillReferrerBatch(ctx context.Context, db *sql.DB, classifier *referrer.Classifier, afterID, batchSize int) (int, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, COALESCE(referrer, '') FROM visits
+		WHERE referrer_class IS NULL AND NOT anonymous AND id > $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`, afterID, batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		ids            []int64
+		hosts, classes []sql.NullString
+	)
+	for rows.Next() {
+		var id int64
+		var raw string
+		if err := rows.Scan(&id, &raw); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ref := classifier.Classify(raw, "", "")
+		ids = append(ids, id)
+		hosts = append(hosts, nullString(truncate(ref.Host, 255)))
+		classes = append(classes, nullString(ref.Class))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, afterID, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE visits SET referrer_host = u.host, referrer_class = u.class
+		FROM (SELECT unnest($1::bigint[]) AS id, unnest($2::text[]) AS host, unnest($3::text[]) AS class) u
+		WHERE visits.id = u.id`,
+		pq.Array(ids), pq.Array(hosts), pq.Array(classes))
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(ids), int(ids[len(ids)-1]), nil
+}
@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/visitorid"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rollupLockKey is the Postgres advisory lock taken while a day is rolled up, so replicas running the
+// rollup at the same time do not contend on the same rows
+const rollupLockKey = 0x73687572_6c01
+
+// RollupVisits folds the visits recorded before the UTC day of before into visit_daily_rollups and
+// deletes them, oldest day first. Each day is counted, its visitors added to its sketches and its visits
+// deleted in one transaction, so the job can be interrupted and re-run at any time without counting
+// a visit twice. It stops early when another replica holds the rollup lock, and returns the number of
+// days rolled up.
+func RollupVisits(ctx context.Context, db *sql.DB, logger *zap.Logger, before time.Time) (int, error) {
+	cutoff := before.UTC().Truncate(24 * time.Hour)
+	days := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return days, err
+		}
+
+		var oldest sql.NullTime
+		err := db.QueryRowContext(ctx, `SELECT MIN(created_at)::date FROM visits WHERE created_at < $1`, cutoff).Scan(&oldest)
+		if err != nil || !oldest.Valid {
+			return days, err
+		}
+
+		visits, locked, err := rollupDay(ctx, db, oldest.Time)
+		if err != nil || !locked {
+			return days, err
+		}
+		days++
+		logger.Info("rolled up visits", zap.String("day", visitorid.Day(oldest.Time)), zap.Int64("visits", visits))
+	}
+}
+
+// rollupDay moves the visits of day into visit_daily_rollups. It reports false when another replica
+// holds the rollup lock.
+func rollupDay(ctx context.Context, db *sql.DB, day time.Time) (int64, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, rollupLockKey).Scan(&locked); err != nil || !locked {
+		return 0, false, err
+	}
+
+	// Unique visitors cannot be counted once the visitor hashes are gone, so they are added to the
+	// day's sketches before the visits are deleted. Adding a visitor twice does not change a sketch,
+	// and a day rolled up again for visits written late keeps the visitors of its earlier rollup.
+	if err := mergeDaySketches(ctx, tx, day); err != nil {
+		return 0, false, err
+	}
+
+	// Deleting and counting in one statement counts exactly the rows removed. Rows of a day already
+	// rolled up, such as visits written late, are added to the existing counts.
+	var visits int64
+	err = tx.QueryRowContext(ctx, `WITH deleted AS (
+			DELETE FROM visits
+			WHERE created_at >= $1 AND created_at < $1::timestamp + interval '1 day'
+			RETURNING link_id, is_bot, country, device_type, referrer_class, source
+		), counted AS (
+			INSERT INTO visit_daily_rollups AS r (link_id, day, is_bot, country, device_type, referrer_class, source, visits)
+			SELECT link_id, $1::date, is_bot, COALESCE(country, ''), COALESCE(device_type, ''),
+				COALESCE(referrer_class, ''), source, COUNT(*)
+			FROM deleted
+			GROUP BY link_id, is_bot, COALESCE(country, ''), COALESCE(device_type, ''), COALESCE(referrer_class, ''), source
+			ON CONFLICT (link_id, day, is_bot, country, device_type, referrer_class, source)
+			DO UPDATE SET visits = r.visits + EXCLUDED.visits
+		)
+		SELECT COUNT(*) FROM deleted`, day).Scan(&visits)
+	if err != nil {
+		return 0, false, err
+	}
+	return visits, true, tx.Commit()
+}
@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/visitorid"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BackfillVisitorSketches rebuilds the daily visitor sketches from the visitor hashes stored on visits,
+// for every day before today that has human visits. Each day is rebuilt from scratch in its own
+// transaction, so the job can be interrupted and re-run at any time. Days already rolled up have lost
+// some of their visits, so their sketches are only added to. Today is left to the recorder, which is
+// still adding to it. It returns the number of days rebuilt.
+func BackfillVisitorSketches(ctx context.Context, db *sql.DB, logger *zap.Logger) (int, error) {
+	var first, last sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT MIN(created_at)::date, MAX(created_at)::date FROM visits
+		WHERE created_at < CURRENT_DATE AND NOT is_bot`).Scan(&first, &last)
+	if err != nil || !first.Valid {
+		return 0, err
+	}
+
+	days := 0
+	for day := first.Time; !day.After(last.Time); day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return days, err
+		}
+		links, err := rebuildSketches(ctx, db, day)
+		if err != nil {
+			return days, err
+		}
+		days++
+		logger.Info("rebuilt visitor sketches", zap.String("day", visitorid.Day(day)), zap.Int("links", links))
+	}
+	return days, nil
+}
+
+// rebuildSketches replaces the sketches of day with ones built from that day's visits, or adds the
+// visits to them when the day has been rolled up
+func rebuildSketches(ctx context.Context, db *sql.DB, day time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var rolledUp bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM visit_daily_rollups WHERE day = $1)`, visitorid.Day(day)).Scan(&rolledUp)
+	if err != nil {
+		return 0, err
+	}
+	visitors, err := dayVisitors(ctx, tx, day)
+	if err != nil {
+		return 0, err
+	}
+	if !rolledUp {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM visitor_sketches WHERE day = $1`, visitorid.Day(day)); err != nil {
+			return 0, err
+		}
+	}
+	if err := visitorid.UpdateSketches(ctx, tx, visitors); err != nil {
+		return 0, err
+	}
+	return len(visitors), tx.Commit()
+}
+
+// mergeDaySketches adds the visitors of day still in visits to the day's sketches within tx. The
+// sketches are never rebuilt here, as visitors of a day rolled up before are only in its sketches.
+func mergeDaySketches(ctx context.Context, tx *sql.Tx, day time.Time) error {
+	visitors, err := dayVisitors(ctx, tx, day)
+	if err != nil {
+		return err
+	}
+	return visitorid.UpdateSketches(ctx, tx, visitors)
+}
+
+// dayVisitors reads the visitor hashes of the human visits of day, by link
+func dayVisitors(ctx context.Context, tx *sql.Tx, day time.Time) (map[visitorid.SketchKey][]int64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT link_id, visitor_hash FROM visits
+		WHERE created_at >= $1 AND created_at < $1::timestamp + interval '1 day'
+			AND NOT is_bot AND visitor_hash IS NOT NULL`, day)
+	if err != nil {
+		return nil, err
+	}
+	visitors := make(map[visitorid.SketchKey][]int64)
+	for rows.Next() {
+		var linkID int
+		var hash int64
+		if err := rows.Scan(&linkID, &hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		key := visitorid.SketchKey{LinkID: linkID, Day: visitorid.Day(day)}
+		visitors[key] = append(visitors[key], hash)
+	}
+	rows.Close()
+	return visitors, rows.Err()
+}
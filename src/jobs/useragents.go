@@ -0,0 +1,94 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/useragent"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// BackfillUserAgents parses the user agent of every visit recorded before user agents were parsed at
+// record time. It returns the number of visits updated.
+func BackfillUserAgents(ctx context.Context, db *sql.DB, logger *zap.Logger, batchSize int) (int, error) {
+	return backfill(ctx, db, logger, "user agents", batchSize, backfillUserAgentBatch)
+}
+
+// backfillUserAgentBatch parses up to batchSize unparsed visits with an id above afterID and returns
+// how many were updated along with the highest id seen
+func backfillUserAgentBatch(ctx context.Context, db *sql.DB, afterID, batchSize int) (int, int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, user_agent FROM visits
+		WHERE device_type IS NULL AND NOT anonymous AND id > $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`, afterID, batchSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		ids                                                        []int64
+		browsers, browserVersions, oses, osVersions, devices, bots []sql.NullString
+	)
+	for rows.Next() {
+		var id int64
+		var ua string
+		if err := rows.Scan(&id, &ua); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		info := useragent.Parse(ua)
+		ids = append(ids, id)
+		browsers = append(browsers, nullString(info.Browser))
+		browserVersions = append(browserVersions, nullString(info.BrowserVersion))
+		oses = append(oses, nullString(info.OS))
+		osVersions = append(osVersions, nullString(info.OSVersion))
+		devices = append(devices, nullString(info.DeviceType))
+		bots = append(bots, nullString(info.BotName))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, afterID, nil
+	}
+
+	// Visits found to be bots are flagged and taken out of their link's visits_count. Unparsed visits
+	// predate is_bot and were never flagged, so every bot in the batch is a newly found one.
+	_, err = tx.ExecContext(ctx, `WITH u AS (
+			SELECT
+				unnest($1::bigint[]) AS id,
+				unnest($2::text[]) AS browser, unnest($3::text[]) AS browser_version,
+				unnest($4::text[]) AS os, unnest($5::text[]) AS os_version,
+				unnest($6::text[]) AS device_type, unnest($7::text[]) AS bot_name
+		), updated AS (
+			UPDATE visits SET
+				browser = u.browser, browser_version = u.browser_version,
+				os = u.os, os_version = u.os_version,
+				device_type = u.device_type, bot_name = u.bot_name,
+				is_bot = visits.is_bot OR u.device_type = 'bot'
+			FROM u
+			WHERE visits.id = u.id
+			RETURNING visits.link_id, u.device_type = 'bot' AS bot
+		)
+		UPDATE links SET visits_count = GREATEST(links.visits_count - c.n, 0)
+		FROM (SELECT link_id, COUNT(*) AS n FROM updated WHERE bot GROUP BY link_id) c
+		WHERE links.id = c.link_id`,
+		pq.Array(ids), pq.Array(browsers), pq.Array(browserVersions),
+		pq.Array(oses), pq.Array(osVersions), pq.Array(devices), pq.Array(bots))
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return len(ids), int(ids[len(ids)-1]), nil
+}
@@ -0,0 +1,312 @@
+package linkcache
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"os"
+	"shurl/src/config"
+	"shurl/src/models"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// channel is the Postgres NOTIFY channel used to propagate invalidations between replicas
+const channel = "link_cache_invalidate"
+
+// purgeAll is the notification payload that clears every entry. Short codes are alphanumeric,
+// so it never collides with a code.
+const purgeAll = "*"
+
+// Entry is what a redirect needs to know about a short code
+type Entry struct {
+	// Found is false for codes that do not exist, which are cached too
+	Found  bool
+	Link   models.Link
+	Pixels []models.Pixel
+}
+
+// Loader fetches the entry for a code from the database, within ctx
+type Loader func(ctx context.Context, code string) (Entry, error)
+
+// Options configures the cache
+type Options struct {
+	Enabled     bool
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+// OptionsFromEnv reads the cache options from the environment
+func OptionsFromEnv() Options {
+	enabled, err := strconv.ParseBool(os.Getenv("LINK_CACHE_ENABLED"))
+	if err != nil {
+		enabled = true
+	}
+	return Options{
+		Enabled:     enabled,
+		Size:        config.GetEnvInt("LINK_CACHE_SIZE", 10000),
+		TTL:         config.GetEnvDuration("LINK_CACHE_TTL", 5*time.Minute),
+		NegativeTTL: config.GetEnvDuration("LINK_CACHE_NEGATIVE_TTL", 30*time.Second),
+	}
+}
+
+// Stats is a snapshot of the cache counters
+type Stats struct {
+	Enabled       bool    `json:"enabled"`
+	Size          int     `json:"size"`
+	Capacity      int     `json:"capacity"`
+	Hits          int64   `json:"hits"`
+	NegativeHits  int64   `json:"negative_hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hit_rate"`
+	Evictions     int64   `json:"evictions"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+type item struct {
+	code      string
+	entry     Entry
+	expiresAt time.Time
+}
+
+// flight tracks the loads of one code that are in progress. Invalidating the code bumps its
+// generation, so loads started before then know their result may be stale.
+type flight struct {
+	generation uint64
+	loads      int
+}
+
+// Cache is a size-bounded LRU cache of short code lookups with per-entry expiry
+type Cache struct {
+	db     *sql.DB
+	opts   Options
+	load   Loader
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	// flights holds the codes being loaded, and epoch counts the times the whole cache was cleared,
+	// so that an entry loaded across an invalidation is not cached
+	flights map[string]*flight
+	epoch   uint64
+
+	listener *pq.Listener
+	done     chan struct{}
+
+	hits          atomic.Int64
+	negativeHits  atomic.Int64
+	misses        atomic.Int64
+	evictions     atomic.Int64
+	invalidations atomic.Int64
+}
+
+// New creates a cache in front of load
+func New(db *sql.DB, opts Options, load Loader) *Cache {
+	if opts.Size < 1 {
+		opts.Size = 1
+	}
+	return &Cache{
+		db:      db,
+		opts:    opts,
+		load:    load,
+		logger:  config.GetLogger(),
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+		flights: make(map[string]*flight),
+		done:    make(chan struct{}),
+	}
+}
+
+// Get returns the entry for code, loading and caching it on a miss. ctx is passed to the loader.
+func (c *Cache) Get(ctx context.Context, code string) (Entry, error) {
+	if !c.opts.Enabled {
+		return c.load(ctx, code)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	if el, ok := c.items[code]; ok {
+		it := el.Value.(*item)
+		if now.Before(it.expiresAt) {
+			c.order.MoveToFront(el)
+			c.mu.Unlock()
+			if it.entry.Found {
+				c.hits.Add(1)
+			} else {
+				c.negativeHits.Add(1)
+			}
+			return it.entry, nil
+		}
+		c.remove(el)
+	}
+	f, ok := c.flights[code]
+	if !ok {
+		f = &flight{}
+		c.flights[code] = f
+	}
+	f.loads++
+	generation, epoch := f.generation, c.epoch
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+	entry, err := c.load(ctx, code)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// An update or delete that invalidated the code while it was loading may not be reflected in
+	// entry, so it is returned without being cached
+	stale := f.generation != generation || c.epoch != epoch
+	if f.loads--; f.loads == 0 {
+		delete(c.flights, code)
+	}
+	if err != nil || stale {
+		return entry, err
+	}
+	c.put(code, entry, now)
+	return entry, nil
+}
+
+// Invalidate drops code from this cache and from the caches of all other replicas
+func (c *Cache) Invalidate(code string) {
+	c.evict(code)
+	c.notify(code)
+}
+
+// InvalidateAll clears this cache and the caches of all other replicas
+func (c *Cache) InvalidateAll() {
+	c.clear()
+	c.notify(purgeAll)
+}
+
+// Listen subscribes to invalidations published by other replicas
+func (c *Cache) Listen() {
+	if !c.opts.Enabled {
+		c.logger.Info("link cache disabled")
+		return
+	}
+
+	c.listener = pq.NewListener(os.Getenv("POSTGRES_URI"), time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				c.logger.Warn("link cache listener event", zap.Int("event", int(event)), zap.Error(err))
+			}
+		})
+	if err := c.listener.Listen(channel); err != nil {
+		c.logger.Error("failed to listen for link cache invalidations", zap.Error(err))
+	}
+
+	go func() {
+		for {
+			select {
+			case n := <-c.listener.Notify:
+				// A nil notification means the connection was re-established and
+				// invalidations may have been missed
+				if n == nil || n.Extra == purgeAll {
+					c.clear()
+					continue
+				}
+				c.evict(n.Extra)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	c.logger.Info("link cache listening for invalidations", zap.Int("size", c.opts.Size))
+}
+
+// Close stops listening for invalidations
+func (c *Cache) Close() error {
+	close(c.done)
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Close()
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	stats := Stats{
+		Enabled:       c.opts.Enabled,
+		Size:          size,
+		Capacity:      c.opts.Size,
+		Hits:          c.hits.Load(),
+		NegativeHits:  c.negativeHits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+	if lookups := stats.Hits + stats.NegativeHits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits+stats.NegativeHits) / float64(lookups)
+	}
+	return stats
+}
+
+// put stores an entry, evicting the least recently used one when full. Entries of expiring links
+// are kept no longer than the link's expiry, so an expired link is never served from the cache.
+// The caller must hold mu.
+func (c *Cache) put(code string, entry Entry, now time.Time) {
+	ttl := c.opts.TTL
+	if !entry.Found {
+		ttl = c.opts.NegativeTTL
+	}
+	expiresAt := now.Add(ttl)
+	if entry.Found && entry.Link.ExpiresAt != nil && entry.Link.ExpiresAt.Before(expiresAt) {
+		expiresAt = *entry.Link.ExpiresAt
+	}
+
+	if el, ok := c.items[code]; ok {
+		el.Value = &item{code: code, entry: entry, expiresAt: expiresAt}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[code] = c.order.PushFront(&item{code: code, entry: entry, expiresAt: expiresAt})
+	for c.order.Len() > c.opts.Size {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache) evict(code string) {
+	c.invalidations.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[code]; ok {
+		c.remove(el)
+	}
+	if f, ok := c.flights[code]; ok {
+		f.generation++
+	}
+}
+
+func (c *Cache) clear() {
+	c.invalidations.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.epoch++
+}
+
+// remove unlinks an element; the caller must hold mu
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*item).code)
+}
+
+// notify publishes an invalidation to every replica, including this one
+func (c *Cache) notify(payload string) {
+	if _, err := c.db.Exec("SELECT pg_notify($1, $2)", channel, payload); err != nil {
+		c.logger.Error("failed to publish link cache invalidation", zap.String("payload", payload), zap.Error(err))
+	}
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"shurl/src/anomaly"
+	"shurl/src/commands"
 	"shurl/src/config"
 	"shurl/src/db"
+	"shurl/src/geoip"
+	"shurl/src/handlers"
+	"shurl/src/linkcache"
+	"shurl/src/privacy"
+	"shurl/src/recorder"
+	"shurl/src/retention"
 	"shurl/src/routes"
+	"shurl/src/tracing"
+	"shurl/src/validation"
+	"shurl/src/visitfeed"
+	"shurl/src/visitorid"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/joho/godotenv/autoload"
@@ -18,32 +32,123 @@ import (
 func main() {
 	var err error
 
-	router := gin.Default()
+	// Maintenance commands run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(commands.Run(os.Args[1:]))
+	}
+
+	// Request logging and recovery are added in SetupRoutes, in place of gin's defaults
+	router := gin.New()
 	logger := config.GetLogger()
+
+	if err := validation.RegisterRules(); err != nil {
+		logger.Fatal("failed to register validation rules", zap.Error(err))
+	}
+
+	// Spans are exported when TRACING_EXPORTER is set; trace context is propagated either way
+	traces, err := tracing.New(context.Background(), tracing.OptionsFromEnv())
+	if err != nil {
+		logger.Fatal("invalid tracing configuration", zap.Error(err))
+	}
+
 	db, err := db.Connect()
 	if err != nil {
 		logger.Fatal("failed to connect to database", zap.Error(err))
 	}
 
+	// Visits are located from a local GeoIP database when one is configured
+	geo := geoip.New(geoip.OptionsFromEnv())
+	geo.Start()
+
+	// What is stored about visitors follows the configured privacy mode
+	recorderOpts := recorder.OptionsFromEnv()
+	recorderOpts.Privacy, err = privacy.OptionsFromEnv()
+	if err != nil {
+		logger.Fatal("invalid privacy configuration", zap.Error(err))
+	}
+
+	// Visits are written in the background so redirects do not wait on Postgres.
+	// Visitors are identified by daily-salted hashes, so uniques never need the raw IP
+	rec := recorder.New(db, recorderOpts, geo, visitorid.New(db))
+	rec.Start()
+
+	// Short code lookups are cached, with invalidations shared between replicas
+	cache := linkcache.New(db, linkcache.OptionsFromEnv(), handlers.LinkCacheLoader(db))
+	cache.Listen()
+
+	// Visits are also pushed to live streams, on every replica
+	feedOpts := visitfeed.OptionsFromEnv()
+	feedOpts.Privacy = recorderOpts.Privacy
+	feed := visitfeed.New(db, feedOpts, geo)
+	feed.Start()
+
+	// Raw visits past the retention period are rolled up into daily counts
+	rollups := retention.New(db, retention.OptionsFromEnv())
+	rollups.Start()
+
+	// Hours with unusual spikes or drops in a link's visits are flagged
+	anomalies := anomaly.New(db, anomaly.OptionsFromEnv())
+	anomalies.Start()
+
 	// Set up all routes
-	routes.SetupRoutes(router, db, logger)
+	routes.SetupRoutes(router, db, logger, rec, cache, geo, rollups, feed, anomalies)
 
 	logger.Info("starting server on port", zap.String("port", os.Getenv("PORT")))
 	server := &http.Server{
 		Addr:    ":" + os.Getenv("PORT"),
 		Handler: router,
 	}
+	// Live streams never finish on their own, so they are ended as soon as shutdown begins
+	// instead of holding their connections until the deadline
+	feedClosed := make(chan struct{})
+	server.RegisterOnShutdown(func() {
+		defer close(feedClosed)
+		if err := feed.Close(); err != nil {
+			logger.Error("Error closing visit stream listener", zap.Error(err))
+		}
+	})
 
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Fatal("listen: %s\n", zap.Error(err))
+			logger.Fatal("failed to start server", zap.Error(err))
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	logger.Info("Shutting down server...")
+	sig := <-quit
+	shutdownTimeout := config.GetEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	logger.Info("Shutting down server...", zap.String("signal", sig.String()), zap.Duration("timeout", shutdownTimeout))
+
+	// Stop accepting connections and let in-flight requests finish, so redirects and link
+	// creations still have the database; connections left at the deadline are closed
+	start := time.Now()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("HTTP requests did not finish in time, closing their connections", zap.Error(err))
+		server.Close()
+	} else {
+		logger.Info("HTTP requests drained", zap.Duration("took", time.Since(start)))
+	}
+	cancel()
+	<-feedClosed
+
+	// Flush queued visits and stop the background jobs before the database connection goes away
+	logger.Info("Stopping background workers", zap.Any("visit_recorder", rec.Stats()))
+	start = time.Now()
+	drainCtx, cancel := context.WithTimeout(context.Background(), config.GetEnvDuration("VISIT_DRAIN_TIMEOUT", 10*time.Second))
+	if err := rec.Shutdown(drainCtx); err != nil {
+		logger.Error("Error draining visit recorder", zap.Error(err), zap.Any("stats", rec.Stats()))
+	}
+	cancel()
+	rollups.Close()
+	anomalies.Close()
+	geo.Close()
+
+	if err := cache.Close(); err != nil {
+		logger.Error("Error closing link cache listener", zap.Error(err))
+	}
+	logger.Info("Background workers stopped", zap.Duration("took", time.Since(start)))
 
 	if db != nil {
 		if err := db.Close(); err != nil {
@@ -53,5 +158,12 @@ func main() {
 		}
 	}
 
+	// Spans of the requests and jobs above are exported before exiting
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := traces.Shutdown(flushCtx); err != nil {
+		logger.Error("Error flushing traces", zap.Error(err))
+	}
+	cancel()
+
 	logger.Info("Server exiting")
 }
@@ -0,0 +1,161 @@
+// Package metrics collects the service's operational metrics and serves them in the Prometheus
+// text format. Request, redirect and link metrics are recorded as they happen; the state of the
+// database pool, visit recorder and link cache is read from their stats when scraped.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"shurl/src/linkcache"
+	"shurl/src/recorder"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "shurl"
+
+// Redirect outcomes
+const (
+	// OutcomeHit is a redirect to the destination of an existing link
+	OutcomeHit = "hit"
+	// OutcomeBot is a hit by a bot, which is redirected without being counted
+	OutcomeBot = "bot"
+	// OutcomeNotFound is a request for an unknown short code
+	OutcomeNotFound = "not_found"
+	// OutcomeExpired is a request for a link past its expiry
+	OutcomeExpired = "expired"
+	// OutcomeError is a lookup that failed
+	OutcomeError = "error"
+)
+
+// registry holds every metric; the process and Go runtime collectors are included
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests, by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	redirects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redirects_total",
+		Help:      "Short link requests, by outcome: hit, bot, not_found, expired or error.",
+	}, []string{"outcome"})
+
+	linksCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "links_created_total",
+		Help:      "Short links created.",
+	})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, redirects, linksCreated,
+	)
+	// Every outcome is exported from the start, so rates work before the first occurrence
+	for _, outcome := range []string{OutcomeHit, OutcomeBot, OutcomeNotFound, OutcomeExpired, OutcomeError} {
+		redirects.WithLabelValues(outcome)
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts and times requests by their route pattern, such as /api/links/:id, so that
+// short codes and IDs do not each become a time series. Unmatched requests share one route label.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Redirect counts a short link request with its outcome
+func Redirect(outcome string) {
+	redirects.WithLabelValues(outcome).Inc()
+}
+
+// LinkCreated counts a newly created short link
+func LinkCreated() {
+	linksCreated.Inc()
+}
+
+// RegisterDB exports the connection pool statistics of db as the go_sql_* metrics
+func RegisterDB(db *sql.DB) {
+	registry.MustRegister(collectors.NewDBStatsCollector(db, namespace))
+}
+
+// RegisterRecorder exports the queue and write counters of the visit recorder
+func RegisterRecorder(rec *recorder.Recorder) {
+	stat := func(name, help string, counter bool, value func(recorder.Stats) int64) prometheus.Collector {
+		opts := prometheus.Opts{Namespace: namespace, Subsystem: "visit_recorder", Name: name, Help: help}
+		read := func() float64 { return float64(value(rec.Stats())) }
+		if counter {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts(opts), read)
+		}
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts(opts), read)
+	}
+	registry.MustRegister(
+		stat("queue_depth", "Visits waiting in the queue.", false, func(s recorder.Stats) int64 { return int64(s.QueueDepth) }),
+		stat("queue_capacity", "Size of the visit queue.", false, func(s recorder.Stats) int64 { return int64(s.QueueCapacity) }),
+		stat("enqueued_total", "Visits queued for writing.", true, func(s recorder.Stats) int64 { return s.Enqueued }),
+		stat("dropped_total", "Visits dropped because the queue was full.", true, func(s recorder.Stats) int64 { return s.Dropped }),
+		stat("sync_writes_total", "Visits written inline because the queue was full.", true, func(s recorder.Stats) int64 { return s.SyncWrites }),
+		stat("written_total", "Visits written to the database.", true, func(s recorder.Stats) int64 { return s.Written }),
+		stat("failed_total", "Visits that could not be written.", true, func(s recorder.Stats) int64 { return s.Failed }),
+		stat("batches_total", "Batches of visits written.", true, func(s recorder.Stats) int64 { return s.Batches }),
+		stat("abandoned_total", "Queued visits left unwritten because shutdown timed out.", true, func(s recorder.Stats) int64 { return s.Abandoned }),
+	)
+}
+
+// RegisterCache exports the lookups of the link cache. The hit rate is
+// rate(shurl_link_cache_hits_total[5m]) / rate(shurl_link_cache_lookups_total[5m]).
+func RegisterCache(cache *linkcache.Cache) {
+	stat := func(name, help string, counter bool, value func(linkcache.Stats) float64) prometheus.Collector {
+		opts := prometheus.Opts{Namespace: namespace, Subsystem: "link_cache", Name: name, Help: help}
+		read := func() float64 { return value(cache.Stats()) }
+		if counter {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts(opts), read)
+		}
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts(opts), read)
+	}
+	registry.MustRegister(
+		stat("entries", "Short codes in the cache.", false, func(s linkcache.Stats) float64 { return float64(s.Size) }),
+		stat("hits_total", "Lookups answered from the cache, including unknown codes.", true, func(s linkcache.Stats) float64 {
+			return float64(s.Hits + s.NegativeHits)
+		}),
+		stat("lookups_total", "Lookups through the cache.", true, func(s linkcache.Stats) float64 {
+			return float64(s.Hits + s.NegativeHits + s.Misses)
+		}),
+		stat("hit_ratio", "Share of lookups answered from the cache since startup.", false, func(s linkcache.Stats) float64 { return s.HitRate }),
+		stat("evictions_total", "Entries evicted to make room.", true, func(s linkcache.Stats) float64 { return float64(s.Evictions) }),
+		stat("invalidations_total", "Entries invalidated by link changes.", true, func(s linkcache.Stats) float64 { return float64(s.Invalidations) }),
+	)
+}
@@ -0,0 +1,99 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"shurl/src/config"
+	"shurl/src/tracing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RequestIDHeader carries the ID of a request, both from upstream proxies and in responses
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// quietRoutes are polled by probes and scrapers, so their successful requests are only logged at debug level
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// RequestLogger assigns every request an ID, keeping a valid X-Request-ID from the client or a proxy
+// and generating one otherwise, and returns it in the response. A logger annotated with the request
+// ID, route, client IP and, after Tracing, the trace and span IDs is put in the request context for
+// handlers, and one access log line is written per request: at error level for 5xx responses and
+// warn level for 4xx.
+func RequestLogger(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Header(RequestIDHeader, id)
+
+		route := c.FullPath()
+		ctx := c.Request.Context()
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request.id", id))
+		requestLogger := tracing.Logger(ctx, logger.With(
+			zap.String("request_id", id),
+			zap.String("route", route),
+			zap.String("client_ip", c.ClientIP()),
+		))
+		c.Request = c.Request.WithContext(config.WithLogger(ctx, requestLogger))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := zapcore.InfoLevel
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = zapcore.ErrorLevel
+		case status >= http.StatusBadRequest:
+			level = zapcore.WarnLevel
+		case quietRoutes[route]:
+			level = zapcore.DebugLevel
+		}
+		fields := []zap.Field{
+			zap.String("method", c.Request.Method),
+			// The query string is left out, as it can carry campaign parameters and other personal data
+			zap.String("path", c.Request.URL.Path),
+			zap.Int("status", status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("bytes", c.Writer.Size()),
+			zap.String("user_agent", c.Request.UserAgent()),
+		}
+		if len(c.Errors) > 0 {
+			fields = append(fields, zap.String("errors", c.Errors.String()))
+		}
+		requestLogger.Log(level, "request", fields...)
+	}
+}
+
+// Recovery turns a panic in a handler into a 500 response, logged with the request's logger
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		config.LoggerFromContext(c.Request.Context()).Error("panic while handling request",
+			zap.Any("panic", err), zap.Stack("stack"))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces, so they are safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
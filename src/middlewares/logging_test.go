@@ -0,0 +1,70 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"uuid", "3f2b8c1e-7d4a-4e9b-9c51-0a6e2f1d8b77", true},
+		{"proxy id", "Root=1-67891233-abcdef012345678912345678", true},
+		{"empty", "", false},
+		{"space", "abc def", false},
+		{"newline", "abc\ninjected", false},
+		{"non-ascii", "abcé", false},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validRequestID(tt.id); got != tt.want {
+				t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLoggerRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestLogger(zap.NewNop()))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"kept from the client", "abc-123", true},
+		{"generated when missing", "", false},
+		{"replaced when invalid", "bad id", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				r.Header.Set(RequestIDHeader, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			got := w.Header().Get(RequestIDHeader)
+			switch {
+			case tt.keep && got != tt.incoming:
+				t.Errorf("%s = %q, want %q", RequestIDHeader, got, tt.incoming)
+			case !tt.keep && (got == tt.incoming || !validRequestID(got)):
+				t.Errorf("%s = %q, want a new valid id", RequestIDHeader, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"shurl/src/config"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// MetricsAuth guards the metrics endpoint, separately from the dashboard credentials.
+// Requests must come from an address in the comma-separated METRICS_ALLOWED_IPS, which takes
+// addresses and CIDR ranges, and authenticate with METRICS_USERNAME and METRICS_PASSWORD when
+// those are set. With neither configured only loopback requests are allowed. The address checked is
+// that of the connection, not a forwarding header, so the allow-list cannot be spoofed.
+func MetricsAuth() gin.HandlerFunc {
+	username := os.Getenv("METRICS_USERNAME")
+	password := os.Getenv("METRICS_PASSWORD")
+	allowed, err := parseNetworks(os.Getenv("METRICS_ALLOWED_IPS"))
+	if err != nil {
+		// An invalid allow-list falls back to the most restrictive setting rather than opening up
+		config.GetLogger().Error("invalid METRICS_ALLOWED_IPS, allowing loopback only", zap.Error(err))
+		allowed = nil
+	}
+	loopbackOnly := len(allowed) == 0 && (username == "" || password == "")
+
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.RemoteIP())
+		if ip == nil || (loopbackOnly && !ip.IsLoopback()) || (len(allowed) > 0 && !containsIP(allowed, ip)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		if username != "" && password != "" {
+			user, pass, hasAuth := c.Request.BasicAuth()
+			if !hasAuth ||
+				subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+				c.Header("WWW-Authenticate", "Basic realm=Metrics")
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// parseNetworks parses a comma-separated list of IP addresses and CIDR ranges
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", r)
+			}
+			if ip.To4() != nil {
+				r += "/32"
+			} else {
+				r += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", r)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
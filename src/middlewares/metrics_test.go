@@ -0,0 +1,109 @@
+package middlewares
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks(" 10.0.0.1 , 192.168.0.0/16,,2001:db8::/32, ::1")
+	if err != nil {
+		t.Fatalf("parseNetworks() error = %v", err)
+	}
+	want := []string{"10.0.0.1/32", "192.168.0.0/16", "2001:db8::/32", "::1/128"}
+	if len(networks) != len(want) {
+		t.Fatalf("parseNetworks() = %v, want %v", networks, want)
+	}
+	for i, network := range networks {
+		if network.String() != want[i] {
+			t.Errorf("network %d = %s, want %s", i, network, want[i])
+		}
+	}
+
+	if networks, err := parseNetworks(""); err != nil || len(networks) != 0 {
+		t.Errorf("parseNetworks(\"\") = %v, %v, want no networks", networks, err)
+	}
+	for _, invalid := range []string{"10.0.0", "10.0.0.0/40", "localhost"} {
+		if _, err := parseNetworks(invalid); err == nil {
+			t.Errorf("parseNetworks(%q) error = nil, want an error", invalid)
+		}
+	}
+}
+
+func TestContainsIP(t *testing.T) {
+	networks, err := parseNetworks("10.0.0.1,192.168.0.0/16,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseNetworks() error = %v", err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"192.168.42.7", true},
+		{"192.169.0.1", false},
+		{"2001:db8::7", true},
+		{"2001:db9::7", false},
+		{"::ffff:192.168.1.1", true},
+	}
+	for _, tt := range tests {
+		if got := containsIP(networks, net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("containsIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		allowedIPs string
+		username   string
+		password   string
+		remoteAddr string
+		forwarded  string
+		auth       []string
+		want       int
+	}{
+		{"loopback without configuration", "", "", "", "127.0.0.1:5000", "", nil, http.StatusOK},
+		{"ipv6 loopback without configuration", "", "", "", "[::1]:5000", "", nil, http.StatusOK},
+		{"remote without configuration", "", "", "", "203.0.113.9:5000", "", nil, http.StatusForbidden},
+		{"forwarded header is ignored", "", "", "", "203.0.113.9:5000", "127.0.0.1", nil, http.StatusForbidden},
+		{"allowed range", "10.0.0.0/8", "", "", "10.1.2.3:5000", "", nil, http.StatusOK},
+		{"outside allowed range", "10.0.0.0/8", "", "", "127.0.0.1:5000", "", nil, http.StatusForbidden},
+		{"invalid allow-list falls back to loopback", "not-an-ip", "", "", "10.1.2.3:5000", "", nil, http.StatusForbidden},
+		{"credentials from anywhere", "", "prom", "secret", "203.0.113.9:5000", "", []string{"prom", "secret"}, http.StatusOK},
+		{"missing credentials", "", "prom", "secret", "203.0.113.9:5000", "", nil, http.StatusUnauthorized},
+		{"wrong password", "", "prom", "secret", "203.0.113.9:5000", "", []string{"prom", "wrong"}, http.StatusUnauthorized},
+		{"credentials outside allowed range", "10.0.0.0/8", "prom", "secret", "203.0.113.9:5000", "", []string{"prom", "secret"}, http.StatusForbidden},
+		{"credentials inside allowed range", "10.0.0.0/8", "prom", "secret", "10.1.2.3:5000", "", []string{"prom", "secret"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("METRICS_ALLOWED_IPS", tt.allowedIPs)
+			t.Setenv("METRICS_USERNAME", tt.username)
+			t.Setenv("METRICS_PASSWORD", tt.password)
+
+			router := gin.New()
+			router.GET("/metrics", MetricsAuth(), func(c *gin.Context) { c.Status(http.StatusOK) })
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.auth != nil {
+				r.SetBasicAuth(tt.auth[0], tt.auth[1])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package middlewares
+
+import (
+	"shurl/src/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// Tracing starts a server span for every request, named after its route, continuing the trace of a
+// W3C traceparent header when the caller sends one. Probe and metrics requests are not traced.
+func Tracing() gin.HandlerFunc {
+	return otelgin.Middleware(tracing.ServiceName, otelgin.WithGinFilter(func(c *gin.Context) bool {
+		return !quietRoutes[c.FullPath()]
+	}))
+}
@@ -0,0 +1 @@
+ALTER TABLE visits ADD COLUMN source VARCHAR(32) NOT NULL DEFAULT 'link';
@@ -0,0 +1,4 @@
+ALTER TABLE links
+    ADD COLUMN og_title VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN og_description TEXT DEFAULT NULL,
+    ADD COLUMN og_image TEXT DEFAULT NULL;
@@ -0,0 +1,5 @@
+ALTER TABLE links
+    DROP COLUMN IF EXISTS ios_url,
+    DROP COLUMN IF EXISTS android_url,
+    DROP COLUMN IF EXISTS app_store_url,
+    DROP COLUMN IF EXISTS play_store_url;
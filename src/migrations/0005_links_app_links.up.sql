@@ -0,0 +1,5 @@
+ALTER TABLE links
+    ADD COLUMN ios_url TEXT DEFAULT NULL,
+    ADD COLUMN android_url TEXT DEFAULT NULL,
+    ADD COLUMN app_store_url TEXT DEFAULT NULL,
+    ADD COLUMN play_store_url TEXT DEFAULT NULL;
@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS utm_presets;
+
+DROP INDEX IF EXISTS idx_links_utm_campaign;
+
+ALTER TABLE links
+    DROP COLUMN IF EXISTS utm_source,
+    DROP COLUMN IF EXISTS utm_medium,
+    DROP COLUMN IF EXISTS utm_campaign,
+    DROP COLUMN IF EXISTS utm_term,
+    DROP COLUMN IF EXISTS utm_content;
@@ -0,0 +1,20 @@
+ALTER TABLE links
+    ADD COLUMN utm_source VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_medium VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_campaign VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_term VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_content VARCHAR(255) DEFAULT NULL;
+
+CREATE INDEX idx_links_utm_campaign ON links (utm_campaign);
+
+CREATE TABLE utm_presets (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    utm_source VARCHAR(255) DEFAULT NULL,
+    utm_medium VARCHAR(255) DEFAULT NULL,
+    utm_campaign VARCHAR(255) DEFAULT NULL,
+    utm_term VARCHAR(255) DEFAULT NULL,
+    utm_content VARCHAR(255) DEFAULT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS link_pixels;
+DROP TABLE IF EXISTS pixels;
@@ -0,0 +1,14 @@
+CREATE TABLE pixels (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('image', 'script')),
+    template TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE link_pixels (
+    link_id INT REFERENCES links(id) ON DELETE CASCADE NOT NULL,
+    pixel_id INT REFERENCES pixels(id) ON DELETE CASCADE NOT NULL,
+    PRIMARY KEY (link_id, pixel_id)
+);
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS idx_visits_unparsed;
+DROP INDEX IF EXISTS idx_visits_link_id_created_at;
+
+ALTER TABLE visits
+    DROP COLUMN IF EXISTS browser,
+    DROP COLUMN IF EXISTS browser_version,
+    DROP COLUMN IF EXISTS os,
+    DROP COLUMN IF EXISTS os_version,
+    DROP COLUMN IF EXISTS device_type,
+    DROP COLUMN IF EXISTS bot_name;
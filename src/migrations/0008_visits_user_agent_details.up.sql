@@ -0,0 +1,13 @@
+ALTER TABLE visits
+    ADD COLUMN browser VARCHAR(64) DEFAULT NULL,
+    ADD COLUMN browser_version VARCHAR(32) DEFAULT NULL,
+    ADD COLUMN os VARCHAR(64) DEFAULT NULL,
+    ADD COLUMN os_version VARCHAR(32) DEFAULT NULL,
+    ADD COLUMN device_type VARCHAR(16) DEFAULT NULL,
+    ADD COLUMN bot_name VARCHAR(64) DEFAULT NULL;
+
+-- Per-link lookups, breakdowns and time series all filter on link_id and created_at
+CREATE INDEX IF NOT EXISTS idx_visits_link_id_created_at ON visits (link_id, created_at);
+
+-- Lets the backfill job find the rows it has not parsed yet
+CREATE INDEX IF NOT EXISTS idx_visits_unparsed ON visits (id) WHERE device_type IS NULL;
@@ -0,0 +1,6 @@
+ALTER TABLE visits
+    ADD COLUMN country CHAR(2) DEFAULT NULL,
+    ADD COLUMN region VARCHAR(128) DEFAULT NULL,
+    ADD COLUMN city VARCHAR(128) DEFAULT NULL,
+    ADD COLUMN asn BIGINT DEFAULT NULL,
+    ADD COLUMN as_org VARCHAR(255) DEFAULT NULL;
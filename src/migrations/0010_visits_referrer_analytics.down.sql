@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS idx_visits_unclassified;
+
+ALTER TABLE visits
+    DROP COLUMN IF EXISTS referrer_host,
+    DROP COLUMN IF EXISTS referrer_class,
+    DROP COLUMN IF EXISTS utm_source,
+    DROP COLUMN IF EXISTS utm_medium,
+    DROP COLUMN IF EXISTS utm_campaign,
+    DROP COLUMN IF EXISTS utm_term,
+    DROP COLUMN IF EXISTS utm_content;
+
+ALTER TABLE visits ALTER COLUMN referrer TYPE VARCHAR(255) USING LEFT(referrer, 255);
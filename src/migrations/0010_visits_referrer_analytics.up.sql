@@ -0,0 +1,16 @@
+-- Referrers are no longer cut at 255 characters now that they are aggregated by host
+ALTER TABLE visits ALTER COLUMN referrer TYPE TEXT;
+
+ALTER TABLE visits
+    ADD COLUMN referrer_host VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN referrer_class VARCHAR(16) DEFAULT NULL,
+    ADD COLUMN utm_source VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_medium VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_campaign VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_term VARCHAR(255) DEFAULT NULL,
+    ADD COLUMN utm_content VARCHAR(255) DEFAULT NULL;
+
+-- Visits without a referrer need no parsing; the rest are classified by the backfill-referrers command
+UPDATE visits SET referrer_class = 'direct' WHERE COALESCE(referrer, '') = '';
+
+CREATE INDEX IF NOT EXISTS idx_visits_unclassified ON visits (id) WHERE referrer_class IS NULL;
@@ -0,0 +1,5 @@
+UPDATE links SET visits_count = (
+    SELECT COUNT(*) FROM visits WHERE visits.link_id = links.id
+);
+
+ALTER TABLE visits DROP COLUMN IF EXISTS is_bot;
@@ -0,0 +1,10 @@
+ALTER TABLE visits ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Visits whose user agent was already parsed as a bot are flagged right away; the rest are
+-- flagged by the backfill-user-agents command as it parses them
+UPDATE visits SET is_bot = TRUE WHERE device_type = 'bot';
+
+-- visits_count only counts human visits from now on
+UPDATE links SET visits_count = (
+    SELECT COUNT(*) FROM visits WHERE visits.link_id = links.id AND NOT visits.is_bot
+);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS visitor_sketches;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS visitor_hash;
+
+DROP TABLE IF EXISTS visitor_salts;
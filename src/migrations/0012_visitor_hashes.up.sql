@@ -0,0 +1,25 @@
+-- Daily salts for visitor hashes, deleted once they are no longer needed
+CREATE TABLE visitor_salts (
+    day DATE PRIMARY KEY,
+    salt BYTEA NOT NULL
+);
+
+ALTER TABLE visits ADD COLUMN visitor_hash BIGINT DEFAULT NULL;
+
+-- Historical visits are hashed with a one-off salt that is never stored, keeping one visitor
+-- per link per day as for new visits
+UPDATE visits SET visitor_hash = ('x' || substr(md5(
+        s.salt || ':' || (visits.created_at::date)::text || ':' || visits.link_id::text || ':' ||
+        COALESCE(visits.ip_address, '') || ':' || COALESCE(visits.user_agent, '')
+    ), 1, 16))::bit(64)::bigint
+FROM (SELECT md5(random()::text || clock_timestamp()::text) AS salt) s;
+
+-- HyperLogLog sketches of each link's human visitors per UTC day, for approximate uniques over long ranges
+CREATE TABLE visitor_sketches (
+    link_id INT NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    sketch BYTEA DEFAULT NULL,
+    PRIMARY KEY (link_id, day)
+);
+
+CREATE INDEX IF NOT EXISTS idx_visitor_sketches_day ON visitor_sketches (day);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_visits_ip_mode;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS anonymous;
+
+ALTER TABLE visits DROP COLUMN IF EXISTS ip_mode;
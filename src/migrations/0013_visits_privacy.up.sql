@@ -0,0 +1,7 @@
+-- How the stored IP address was anonymized; existing visits kept the full address
+ALTER TABLE visits ADD COLUMN ip_mode VARCHAR(16) NOT NULL DEFAULT 'full';
+
+-- Visits that asked not to be tracked keep no address, user agent, referrer or visitor hash
+ALTER TABLE visits ADD COLUMN anonymous BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_visits_ip_mode ON visits (ip_mode, id);
@@ -0,0 +1,19 @@
+-- Visits older than the retention period are folded into daily counts per link, split by bot flag,
+-- country, device type, referrer class and source. Unknown values are stored as '' so they take
+-- part in the primary key.
+CREATE TABLE visit_daily_rollups (
+    link_id INT NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    is_bot BOOLEAN NOT NULL,
+    country VARCHAR(2) NOT NULL DEFAULT '',
+    device_type VARCHAR(16) NOT NULL DEFAULT '',
+    referrer_class VARCHAR(16) NOT NULL DEFAULT '',
+    source VARCHAR(32) NOT NULL DEFAULT 'link',
+    visits BIGINT NOT NULL,
+    PRIMARY KEY (link_id, day, is_bot, country, device_type, referrer_class, source)
+);
+
+CREATE INDEX IF NOT EXISTS idx_visit_daily_rollups_day ON visit_daily_rollups (day);
+
+-- Lets the rollup job find the oldest visits and the global stats range-scan visits
+CREATE INDEX IF NOT EXISTS idx_visits_created_at ON visits (created_at);
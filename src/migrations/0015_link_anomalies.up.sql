@@ -0,0 +1,15 @@
+-- Hours in which a link received far more (spike) or far fewer (drop) visits than its baseline.
+-- An hour is flagged at most once per link, however many replicas check it.
+CREATE TABLE link_anomalies (
+    id SERIAL PRIMARY KEY,
+    link_id INT NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+    kind VARCHAR(8) NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    visits INT NOT NULL,
+    baseline DOUBLE PRECISION NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (link_id, bucket)
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_anomalies_bucket ON link_anomalies (bucket);
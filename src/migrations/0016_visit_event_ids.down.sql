@@ -0,0 +1 @@
+DROP SEQUENCE IF EXISTS visit_event_ids;
@@ -0,0 +1,2 @@
+-- Ids of live stream visit events, shared by every replica so clients can resume on any of them
+CREATE SEQUENCE IF NOT EXISTS visit_event_ids;
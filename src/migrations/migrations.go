@@ -0,0 +1,38 @@
+// Package migrations embeds the schema migrations so the server knows which version it expects,
+// without the migration files being shipped alongside the binary
+package migrations
+
+import (
+	"embed"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.up.sql
+var files embed.FS
+
+// Latest returns the version of the newest migration, the version schema_migrations holds once
+// every migration has been applied
+func Latest() (uint, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return 0, err
+	}
+	var latest uint
+	for _, entry := range entries {
+		prefix, _, found := strings.Cut(entry.Name(), "_")
+		if !found {
+			continue
+		}
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+		latest = max(latest, uint(version))
+	}
+	if latest == 0 {
+		return 0, errors.New("no migrations found")
+	}
+	return latest, nil
+}
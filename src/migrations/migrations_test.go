@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLatest(t *testing.T) {
+	latest, err := Latest()
+	if err != nil {
+		t.Fatalf("Latest() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ups := 0
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".up.sql")
+		if !ok {
+			continue
+		}
+		ups++
+		if _, err := os.Stat(name + ".down.sql"); err != nil {
+			t.Errorf("%s has no down migration", entry.Name())
+		}
+	}
+	// Migrations are numbered without gaps, so the newest version is their count
+	if latest != uint(ups) {
+		t.Errorf("Latest() = %d, want %d", latest, ups)
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"net/url"
+	"shurl/src/useragent"
+	"strings"
 	"time"
 )
 
@@ -8,6 +11,203 @@ type InputUrl struct {
 	URL         string     `json:"url" binding:"required,url"`
 	CustomAlias string     `json:"code" binding:"omitempty,alphanum,min=3,max=6"`
 	ExpiresAt   *time.Time `json:"expires_at" binding:"omitempty"`
+	UTMPresetID *int       `json:"utm_preset_id" binding:"omitempty,gt=0"`
+	SocialCard
+	AppLinks
+	UTM
+}
+
+// UpdateLink is the input for replacing the editable fields of an existing link
+type UpdateLink struct {
+	URL         string     `json:"url" binding:"required,url"`
+	ExpiresAt   *time.Time `json:"expires_at" binding:"omitempty"`
+	UTMPresetID *int       `json:"utm_preset_id" binding:"omitempty,gt=0"`
+	SocialCard
+	AppLinks
+	UTM
+}
+
+// SocialCard holds Open Graph overrides served to link-unfurling crawlers
+type SocialCard struct {
+	OGTitle       *string `json:"og_title" binding:"omitempty,max=255"`
+	OGDescription *string `json:"og_description" binding:"omitempty,max=1000"`
+	OGImage       *string `json:"og_image" binding:"omitempty,url"`
+}
+
+// HasOverrides reports whether any Open Graph field is set
+func (s SocialCard) HasOverrides() bool {
+	return s.OGTitle != nil || s.OGDescription != nil || s.OGImage != nil
+}
+
+// AppLinks holds the native app targets a link opens on mobile, with store fallbacks
+// for when the app is not installed
+type AppLinks struct {
+	// IOSURL is a custom-scheme deep link or universal link
+	IOSURL *string `json:"ios_url" binding:"omitempty,url,appurl"`
+	// AndroidURL is an intent:// URL, custom-scheme deep link or app link
+	AndroidURL   *string `json:"android_url" binding:"omitempty,url,appurl"`
+	AppStoreURL  *string `json:"app_store_url" binding:"omitempty,url,appurl"`
+	PlayStoreURL *string `json:"play_store_url" binding:"omitempty,url,appurl"`
+}
+
+// unsafeSchemes run content in the origin of the page that links to them, or read local files,
+// instead of opening a web page or an app
+var unsafeSchemes = map[string]bool{"javascript": true, "data": true, "vbscript": true, "file": true, "blob": true}
+
+// IsAppURL reports whether raw is an absolute URL that opens a web page or an app: http, https or a
+// custom app scheme such as myapp:// or intent://. App URLs are put in the bounce page unfiltered,
+// so schemes that would run script on the shortener's origin are rejected.
+func IsAppURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme == "" {
+		return false
+	}
+	return !unsafeSchemes[parsed.Scheme]
+}
+
+// Target returns the app URL and store fallback for a platform returned by useragent.DetectPlatform
+func (a AppLinks) Target(platform string) (appURL, storeURL string) {
+	deref := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	switch platform {
+	case useragent.PlatformIOS:
+		return deref(a.IOSURL), deref(a.AppStoreURL)
+	case useragent.PlatformAndroid:
+		return deref(a.AndroidURL), deref(a.PlayStoreURL)
+	}
+	return "", ""
+}
+
+// UTM holds the campaign parameters appended to a link's destination on redirect
+type UTM struct {
+	UTMSource   *string `json:"utm_source" binding:"omitempty,max=255"`
+	UTMMedium   *string `json:"utm_medium" binding:"omitempty,max=255"`
+	UTMCampaign *string `json:"utm_campaign" binding:"omitempty,max=255"`
+	UTMTerm     *string `json:"utm_term" binding:"omitempty,max=255"`
+	UTMContent  *string `json:"utm_content" binding:"omitempty,max=255"`
+}
+
+// Merge fills the fields that are unset in u from defaults
+func (u *UTM) Merge(defaults UTM) {
+	if u.UTMSource == nil {
+		u.UTMSource = defaults.UTMSource
+	}
+	if u.UTMMedium == nil {
+		u.UTMMedium = defaults.UTMMedium
+	}
+	if u.UTMCampaign == nil {
+		u.UTMCampaign = defaults.UTMCampaign
+	}
+	if u.UTMTerm == nil {
+		u.UTMTerm = defaults.UTMTerm
+	}
+	if u.UTMContent == nil {
+		u.UTMContent = defaults.UTMContent
+	}
+}
+
+// Apply returns rawURL with the set UTM parameters added, replacing any the destination
+// already carries. The rest of the query is kept byte for byte, so the order, separators and
+// encoding of the destination's own parameters survive, as signed URLs need. The URL is returned
+// unchanged when no parameter is set or it cannot be parsed.
+func (u UTM) Apply(rawURL string) string {
+	params := []struct {
+		name  string
+		value *string
+	}{
+		{"utm_source", u.UTMSource},
+		{"utm_medium", u.UTMMedium},
+		{"utm_campaign", u.UTMCampaign},
+		{"utm_term", u.UTMTerm},
+		{"utm_content", u.UTMContent},
+	}
+	replaced := make(map[string]bool)
+	var added []string
+	for _, p := range params {
+		if p.value != nil && *p.value != "" {
+			replaced[p.name] = true
+			added = append(added, p.name+"="+url.QueryEscape(*p.value))
+		}
+	}
+	if len(added) == 0 {
+		return rawURL
+	}
+	if _, err := url.Parse(rawURL); err != nil {
+		return rawURL
+	}
+
+	// The URL is edited as a string, since re-encoding it with net/url would normalise the query
+	rest, fragment, hasFragment := strings.Cut(rawURL, "#")
+	base, query, _ := strings.Cut(rest, "?")
+	pairs := make([]string, 0, len(added))
+	if query != "" {
+		for _, pair := range strings.Split(query, "&") {
+			if pair == "" {
+				continue
+			}
+			key, _, _ := strings.Cut(pair, "=")
+			if unescaped, err := url.QueryUnescape(key); err == nil {
+				key = unescaped
+			}
+			if !replaced[key] {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	result := base + "?" + strings.Join(append(pairs, added...), "&")
+	if hasFragment {
+		result += "#" + fragment
+	}
+	return result
+}
+
+// UTMPreset is a named, reusable set of UTM parameters
+type UTMPreset struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UTM
+}
+
+// InputUTMPreset is the input for creating or replacing a UTM preset
+type InputUTMPreset struct {
+	Name string `json:"name" binding:"required,max=100"`
+	UTM
+}
+
+// Pixel kinds
+const (
+	PixelKindImage  = "image"
+	PixelKindScript = "script"
+)
+
+// Pixel is a reusable conversion or retargeting snippet fired when a link is clicked.
+// Image pixels hold a URL that is requested as an image; script pixels hold JavaScript
+// that runs on the interstitial page. Both may use the {code}, {link_id} and {url} placeholders.
+type Pixel struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Template  string    `json:"template"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// InputPixel is the input for creating or replacing a pixel
+type InputPixel struct {
+	Name     string `json:"name" binding:"required,max=100"`
+	Kind     string `json:"kind" binding:"required,oneof=image script"`
+	Template string `json:"template" binding:"required,max=10000"`
+}
+
+// InputLinkPixels is the input for replacing the set of pixels attached to a link
+type InputLinkPixels struct {
+	PixelIDs []int `json:"pixel_ids" binding:"required,dive,gt=0"`
 }
 
 type Link struct {
@@ -18,14 +218,91 @@ type Link struct {
 	VisitsCount int        `json:"visits_count"`
 	CreatedAt   time.Time  `json:"created_at"`
 	UpdatedAt   time.Time  `json:"updated_at"`
+	SocialCard
+	AppLinks
+	UTM
 }
 
-type Visit struct {
-	ID        int       `json:"id"`
-	LinkID    int       `json:"link_id"`
-	IPAddress string    `json:"ip_address"`
-	UserAgent string    `json:"user_agent"`
-	Referrer  string    `json:"referrer"`
+// Anomaly is an hour in which a link received far more or far fewer human visits than usual
+type Anomaly struct {
+	ID     int    `json:"id"`
+	LinkID int    `json:"link_id"`
+	Code   string `json:"code"`
+	// Kind is spike or drop
+	Kind string `json:"kind"`
+	// Bucket is the start of the hour, in UTC
+	Bucket time.Time `json:"bucket"`
+	Visits int       `json:"visits"`
+	// Baseline is the mean hourly visits of the link over the baseline period
+	Baseline float64 `json:"baseline"`
+	// Score is how many standard deviations Visits is above (positive) or below the baseline
+	Score     float64   `json:"score"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Visit struct {
+	ID        int    `json:"id"`
+	LinkID    int    `json:"link_id"`
+	IPAddress string `json:"ip_address"`
+	// IPMode is the privacy mode IPAddress was stored under: full, truncate, hash or none
+	IPMode    string `json:"ip_mode"`
+	UserAgent string `json:"user_agent"`
+	Referrer  string `json:"referrer"`
+	// Anonymous visits asked not to be tracked and only count towards totals
+	Anonymous bool `json:"anonymous"`
+	// ReferrerHost and ReferrerClass are null for visits not yet classified by the backfill
+	ReferrerHost  *string   `json:"referrer_host"`
+	ReferrerClass *string   `json:"referrer_class"`
+	Source        string    `json:"source"`
+	IsBot         bool      `json:"is_bot"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	VisitUserAgent
+	VisitLocation
+	// UTM holds the utm_* parameters the visit's request carried
+	UTM
+}
+
+// VisitLocation is where a visit came from according to the GeoIP database. The fields are null
+// when no database was configured or the address was not found in it.
+type VisitLocation struct {
+	Country *string `json:"country"`
+	Region  *string `json:"region"`
+	City    *string `json:"city"`
+	ASN     *int64  `json:"asn"`
+	ASOrg   *string `json:"as_org"`
+}
+
+// VisitUserAgent is the parsed form of a visit's user agent. The fields are null for
+// visits recorded before parsing was introduced that have not been backfilled yet.
+type VisitUserAgent struct {
+	Browser        *string `json:"browser"`
+	BrowserVersion *string `json:"browser_version"`
+	OS             *string `json:"os"`
+	OSVersion      *string `json:"os_version"`
+	DeviceType     *string `json:"device_type"`
+	BotName        *string `json:"bot_name"`
+}
+
+// BrowserLabel is the browser name with its major version, e.g. "Chrome 120"
+func (v VisitUserAgent) BrowserLabel() string {
+	if v.Browser == nil {
+		return ""
+	}
+	if v.BrowserVersion == nil || *v.BrowserVersion == "" {
+		return *v.Browser
+	}
+	major, _, _ := strings.Cut(*v.BrowserVersion, ".")
+	return *v.Browser + " " + major
+}
+
+// OSLabel is the operating system name with its version, e.g. "iOS 17.2"
+func (v VisitUserAgent) OSLabel() string {
+	if v.OS == nil {
+		return ""
+	}
+	if v.OSVersion == nil || *v.OSVersion == "" {
+		return *v.OS
+	}
+	return *v.OS + " " + *v.OSVersion
 }
@@ -0,0 +1,125 @@
+package models
+
+import "testing"
+
+func TestUTMApply(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name string
+		utm  UTM
+		url  string
+		want string
+	}{
+		{"no parameters", UTM{}, "https://example.com/page?a=1", "https://example.com/page?a=1"},
+		{"empty parameters", UTM{UTMSource: str("")}, "https://example.com/", "https://example.com/"},
+		{
+			"adds parameters",
+			UTM{UTMSource: str("newsletter"), UTMMedium: str("email")},
+			"https://example.com/page",
+			"https://example.com/page?utm_source=newsletter&utm_medium=email",
+		},
+		{
+			"keeps other parameters and the fragment",
+			UTM{UTMCampaign: str("spring sale")},
+			"https://example.com/page?a=1#top",
+			"https://example.com/page?a=1&utm_campaign=spring+sale#top",
+		},
+		{
+			"keeps semicolon separated parameters",
+			UTM{UTMSource: str("nl")},
+			"https://ex.com/p?a=1;b=2",
+			"https://ex.com/p?a=1;b=2&utm_source=nl",
+		},
+		{
+			"keeps the order of parameters",
+			UTM{UTMSource: str("nl")},
+			"https://ex.com/p?z=1&a=2",
+			"https://ex.com/p?z=1&a=2&utm_source=nl",
+		},
+		{
+			"keeps percent-encoding",
+			UTM{UTMSource: str("nl")},
+			"https://ex.com/p?sig=abc%7E%2Fdef&path=%2Fa+b",
+			"https://ex.com/p?sig=abc%7E%2Fdef&path=%2Fa+b&utm_source=nl",
+		},
+		{
+			"encodes parameter values",
+			UTM{UTMSource: str("a&b=c"), UTMTerm: str("100% off")},
+			"https://ex.com/p",
+			"https://ex.com/p?utm_source=a%26b%3Dc&utm_term=100%25+off",
+		},
+		{
+			"replaces existing parameters",
+			UTM{UTMSource: str("twitter")},
+			"https://example.com/?utm_source=facebook&utm_medium=social",
+			"https://example.com/?utm_medium=social&utm_source=twitter",
+		},
+		{
+			"replaces encoded parameter names",
+			UTM{UTMSource: str("twitter")},
+			"https://example.com/?utm%5Fsource=facebook&x=1",
+			"https://example.com/?x=1&utm_source=twitter",
+		},
+		{
+			"keeps unset parameters of the destination",
+			UTM{UTMMedium: str("email")},
+			"https://example.com/?utm_source=facebook",
+			"https://example.com/?utm_source=facebook&utm_medium=email",
+		},
+		{
+			"empty query",
+			UTM{UTMSource: str("nl")},
+			"https://ex.com/p?#top",
+			"https://ex.com/p?utm_source=nl#top",
+		},
+		{"unparseable url", UTM{UTMSource: str("x")}, "http://[::1", "http://[::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.utm.Apply(tt.url); got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTMMerge(t *testing.T) {
+	str := func(s string) *string { return &s }
+	u := UTM{UTMSource: str("link")}
+	u.Merge(UTM{UTMSource: str("preset"), UTMMedium: str("email")})
+	if *u.UTMSource != "link" {
+		t.Errorf("UTMSource = %q, want the link's own value", *u.UTMSource)
+	}
+	if u.UTMMedium == nil || *u.UTMMedium != "email" {
+		t.Errorf("UTMMedium = %v, want the preset's value", u.UTMMedium)
+	}
+	if u.UTMCampaign != nil {
+		t.Errorf("UTMCampaign = %q, want nil", *u.UTMCampaign)
+	}
+}
+
+func TestIsAppURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/app", true},
+		{"http://example.com/app", true},
+		{"myapp://open/item/42", true},
+		{"intent://open#Intent;scheme=myapp;package=com.example;end", true},
+		{"market://details?id=com.example", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"vbscript:msgbox(1)", false},
+		{"file:///etc/passwd", false},
+		{"blob:https://example.com/uuid", false},
+		{"/relative/path", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsAppURL(tt.url); got != tt.want {
+			t.Errorf("IsAppURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
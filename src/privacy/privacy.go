@@ -0,0 +1,135 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mode decides how much of a visitor's IP address is stored
+type Mode string
+
+const (
+	// ModeFull stores the address as received
+	ModeFull Mode = "full"
+	// ModeTruncate zeroes the last octet of IPv4 addresses and the last 80 bits of IPv6 addresses
+	ModeTruncate Mode = "truncate"
+	// ModeHash stores a keyed hash of the address, which still tells repeat addresses apart
+	ModeHash Mode = "hash"
+	// ModeNone stores no address
+	ModeNone Mode = "none"
+)
+
+// ranks orders the modes from least to most private. An address can only be moved to a more
+// private mode, as the information the less private modes need is gone.
+var ranks = map[Mode]int{
+	ModeFull:     0,
+	ModeTruncate: 1,
+	ModeHash:     2,
+	ModeNone:     3,
+}
+
+// ParseMode validates a mode name
+func ParseMode(s string) (Mode, error) {
+	mode := Mode(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := ranks[mode]; !ok {
+		return "", fmt.Errorf("privacy mode must be one of full, truncate, hash or none")
+	}
+	return mode, nil
+}
+
+// MorePrivate reports whether addresses stored under from can be converted to m
+func (m Mode) MorePrivate(from Mode) bool {
+	return ranks[m] > ranks[from]
+}
+
+// LessPrivate returns the modes whose addresses can be converted to m
+func (m Mode) LessPrivate() []Mode {
+	var modes []Mode
+	for mode := range ranks {
+		if m.MorePrivate(mode) {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// Options configures what is stored about visitors
+type Options struct {
+	Mode Mode
+	// HashKey keys the address hash of ModeHash, so that hashes cannot be reversed by hashing every address
+	HashKey []byte
+	// HonorDoNotTrack records visits carrying DNT: 1 or Sec-GPC: 1 as anonymous counts only
+	HonorDoNotTrack bool
+}
+
+// OptionsFromEnv reads the privacy options from IP_PRIVACY_MODE (default full), IP_HASH_KEY and
+// HONOR_DO_NOT_TRACK
+func OptionsFromEnv() (Options, error) {
+	opts := Options{Mode: ModeFull, HashKey: []byte(os.Getenv("IP_HASH_KEY"))}
+	if raw := os.Getenv("IP_PRIVACY_MODE"); raw != "" {
+		mode, err := ParseMode(raw)
+		if err != nil {
+			return opts, err
+		}
+		opts.Mode = mode
+	}
+	if opts.Mode == ModeHash && len(opts.HashKey) == 0 {
+		return opts, fmt.Errorf("IP_HASH_KEY is required with the hash privacy mode")
+	}
+	if raw := os.Getenv("HONOR_DO_NOT_TRACK"); raw != "" {
+		honor, err := strconv.ParseBool(raw)
+		if err != nil {
+			return opts, fmt.Errorf("HONOR_DO_NOT_TRACK must be true or false")
+		}
+		opts.HonorDoNotTrack = honor
+	}
+	return opts, nil
+}
+
+// Anonymize converts an address stored under the from mode to the configured mode. It returns
+// the stored value, empty when nothing is stored, and whether a conversion was possible.
+func (o Options) Anonymize(ip string, from Mode) (string, bool) {
+	if ip == "" || o.Mode == from {
+		return ip, true
+	}
+	if !o.Mode.MorePrivate(from) {
+		return ip, false
+	}
+
+	switch o.Mode {
+	case ModeTruncate:
+		return Truncate(ip), true
+	case ModeHash:
+		mac := hmac.New(sha256.New, o.HashKey)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil)[:16]), true
+	case ModeNone:
+		return "", true
+	}
+	return ip, true
+}
+
+// Truncate zeroes the host part of an address: the last octet of IPv4 and the last 80 bits of IPv6.
+// Values that are not addresses are returned unchanged.
+func Truncate(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// DoNotTrack reports whether the request asks not to be tracked with DNT or Global Privacy Control
+func DoNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
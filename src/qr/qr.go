@@ -0,0 +1,199 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Format is an output format for a rendered QR code
+type Format string
+
+const (
+	FormatPNG Format = "png"
+	FormatSVG Format = "svg"
+)
+
+const (
+	DefaultSize   = 256
+	MinSize       = 64
+	MaxSize       = 2048
+	DefaultMargin = 4
+	MaxMargin     = 16
+)
+
+// Options controls how a QR code is rendered
+type Options struct {
+	// Size is the width and height of the image in pixels
+	Size int
+	// Margin is the width of the quiet zone around the code, in modules
+	Margin     int
+	Level      qrcode.RecoveryLevel
+	Foreground color.RGBA
+	Background color.RGBA
+}
+
+// DefaultOptions returns black-on-white options with medium error correction
+func DefaultOptions() Options {
+	return Options{
+		Size:       DefaultSize,
+		Margin:     DefaultMargin,
+		Level:      qrcode.Medium,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+}
+
+// ParseFormat parses an output format name, defaulting to PNG
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "png":
+		return FormatPNG, nil
+	case "svg":
+		return FormatSVG, nil
+	}
+	return "", fmt.Errorf("unsupported format %q, must be png or svg", s)
+}
+
+// ParseLevel parses an error-correction level either by name or by its
+// single-letter QR designation (L, M, Q, H)
+func ParseLevel(s string) (qrcode.RecoveryLevel, error) {
+	switch strings.ToLower(s) {
+	case "low", "l":
+		return qrcode.Low, nil
+	case "", "medium", "m":
+		return qrcode.Medium, nil
+	case "high", "q":
+		return qrcode.High, nil
+	case "highest", "h":
+		return qrcode.Highest, nil
+	}
+	return 0, fmt.Errorf("unsupported error-correction level %q", s)
+}
+
+// ParseColor parses a hex color in the form RGB or RRGGBB, with or without a leading '#'
+func ParseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, must be a hex value like #1a2b3c", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, must be a hex value like #1a2b3c", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// Validate checks that the options are within the supported bounds
+func (o Options) Validate() error {
+	if o.Size < MinSize || o.Size > MaxSize {
+		return fmt.Errorf("size must be between %d and %d pixels", MinSize, MaxSize)
+	}
+	if o.Margin < 0 || o.Margin > MaxMargin {
+		return fmt.Errorf("margin must be between 0 and %d modules", MaxMargin)
+	}
+	if o.Foreground == o.Background {
+		return errors.New("foreground and background colors must differ")
+	}
+	return nil
+}
+
+// Render encodes content as a QR code in the requested format
+func Render(content string, format Format, opts Options) ([]byte, error) {
+	bitmap, err := bitmap(content, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatSVG:
+		return renderSVG(bitmap, opts), nil
+	default:
+		return renderPNG(bitmap, opts)
+	}
+}
+
+// ContentType returns the MIME type for the format
+func (f Format) ContentType() string {
+	if f == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// bitmap returns the QR modules without a border, so the margin can be applied by the renderers
+func bitmap(content string, level qrcode.RecoveryLevel) ([][]bool, error) {
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	return code.Bitmap(), nil
+}
+
+func renderPNG(bitmap [][]bool, opts Options) ([]byte, error) {
+	modules := len(bitmap) + 2*opts.Margin
+	scale := opts.Size / modules
+	if scale < 1 {
+		scale = 1
+	}
+	size := opts.Size
+	if modules*scale > size {
+		size = modules * scale
+	}
+	// Center the code when the size is not an exact multiple of the module count
+	offset := (size-modules*scale)/2 + opts.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{opts.Background, opts.Foreground})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func renderSVG(bitmap [][]bool, opts Options) []byte {
+	modules := len(bitmap) + 2*opts.Margin
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.Size, opts.Size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, modules, modules, hexColor(opts.Background))
+	fmt.Fprintf(&buf, `<path fill="%s" d="`, hexColor(opts.Foreground))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+opts.Margin, y+opts.Margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
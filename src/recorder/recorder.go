@@ -0,0 +1,508 @@
+package recorder
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"shurl/src/config"
+	"shurl/src/geoip"
+	"shurl/src/privacy"
+	"shurl/src/tracing"
+	"shurl/src/visitorid"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+)
+
+// maxColumnLength is the size of the VARCHAR columns of the visits table
+const maxColumnLength = 255
+
+// maxReferrerLength bounds the stored referrer, which is a TEXT column
+const maxReferrerLength = 2048
+
+// Backoff between retries of writes that failed for a reason that may pass, such as a lost
+// connection; it doubles from minRetryBackoff up to maxRetryBackoff
+const (
+	minRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
+
+// Visit is a single click waiting to be written to the visits table
+type Visit struct {
+	LinkID        int
+	IPAddress     string
+	UserAgent     string
+	Referrer      string
+	ReferrerHost  string
+	ReferrerClass string
+	Source        string
+	// UTM holds the utm_* parameters of the incoming request
+	UTM UTM
+	// IsBot is the handler's bot classification, stored as is. Bot visits are not added to the
+	// link's visits_count.
+	IsBot bool
+	// DoNotTrack is set when the request carried DNT or Sec-GPC; such visits are stored as
+	// anonymous counts when the privacy options honor it
+	DoNotTrack bool
+	CreatedAt  time.Time
+}
+
+// UTM is the campaign attribution of a single visit
+type UTM struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Term     string
+	Content  string
+}
+
+// Policy decides what Record does when the queue is full
+type Policy string
+
+const (
+	// PolicySync writes the visit on the caller's goroutine, trading latency for no data loss
+	PolicySync Policy = "sync"
+	// PolicyBlock waits up to BlockTimeout for room in the queue, then drops the visit
+	PolicyBlock Policy = "block"
+	// PolicyDrop drops the visit immediately
+	PolicyDrop Policy = "drop"
+)
+
+// Options configures the recording pipeline
+type Options struct {
+	QueueSize     int
+	Workers       int
+	BatchSize     int
+	FlushInterval time.Duration
+	Policy        Policy
+	BlockTimeout  time.Duration
+	// Privacy decides what is stored about visitors
+	Privacy privacy.Options
+}
+
+// OptionsFromEnv reads the pipeline options from the environment
+func OptionsFromEnv() Options {
+	policy := Policy(os.Getenv("VISIT_QUEUE_FULL_POLICY"))
+	switch policy {
+	case PolicySync, PolicyBlock, PolicyDrop:
+	default:
+		policy = PolicySync
+	}
+	return Options{
+		QueueSize:     config.GetEnvInt("VISIT_QUEUE_SIZE", 10000),
+		Workers:       config.GetEnvInt("VISIT_WORKERS", 2),
+		BatchSize:     config.GetEnvInt("VISIT_BATCH_SIZE", 500),
+		FlushInterval: config.GetEnvDuration("VISIT_FLUSH_INTERVAL", time.Second),
+		Policy:        policy,
+		BlockTimeout:  config.GetEnvDuration("VISIT_QUEUE_BLOCK_TIMEOUT", 50*time.Millisecond),
+	}
+}
+
+// Stats is a snapshot of the pipeline counters
+type Stats struct {
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Policy        Policy `json:"policy"`
+	Enqueued      int64  `json:"enqueued"`
+	Dropped       int64  `json:"dropped"`
+	SyncWrites    int64  `json:"sync_writes"`
+	Written       int64  `json:"written"`
+	Failed        int64  `json:"failed"`
+	Batches       int64  `json:"batches"`
+	// Abandoned counts queued visits left unwritten because Shutdown timed out
+	Abandoned int64 `json:"abandoned"`
+	// Closed is set once Shutdown has been called
+	Closed bool `json:"closed"`
+}
+
+// Recorder buffers visits in a bounded queue that worker goroutines drain, writing them in batches
+// with COPY and applying one visits_count increment per link per batch
+type Recorder struct {
+	db       *sql.DB
+	geo      *geoip.Enricher
+	visitors *visitorid.Hasher
+	opts     Options
+	logger   *zap.Logger
+	queue    chan Visit
+	wg       sync.WaitGroup
+
+	// ctx is cancelled when Shutdown gives up waiting, stopping the workers and their writes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards closed so that Record never sends on the queue after Shutdown closes it
+	mu     sync.RWMutex
+	closed bool
+
+	enqueued   atomic.Int64
+	dropped    atomic.Int64
+	syncWrites atomic.Int64
+	written    atomic.Int64
+	failed     atomic.Int64
+	batches    atomic.Int64
+	abandoned  atomic.Int64
+}
+
+// New creates a recorder that enriches visits with geo and identifies their visitors with visitors
+// when they are written; call Start to launch its workers
+func New(db *sql.DB, opts Options, geo *geoip.Enricher, visitors *visitorid.Hasher) *Recorder {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Recorder{
+		db:       db,
+		geo:      geo,
+		visitors: visitors,
+		opts:     opts,
+		logger:   config.GetLogger(),
+		queue:    make(chan Visit, opts.QueueSize),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start launches the worker goroutines
+func (r *Recorder) Start() {
+	r.logger.Info("starting visit recorder",
+		zap.Int("workers", r.opts.Workers), zap.Int("queueSize", r.opts.QueueSize),
+		zap.Int("batchSize", r.opts.BatchSize), zap.String("policy", string(r.opts.Policy)))
+	for i := 0; i < r.opts.Workers; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+}
+
+// Record queues a visit for writing. It reports false when the visit was dropped. ctx is only used
+// when the visit is written on the caller's goroutine; queued visits are written in their own spans.
+func (r *Recorder) Record(ctx context.Context, v Visit) bool {
+	if v.CreatedAt.IsZero() {
+		v.CreatedAt = time.Now().UTC()
+	}
+	v.IPAddress = truncate(v.IPAddress, maxColumnLength)
+	v.UserAgent = truncate(v.UserAgent, maxColumnLength)
+	v.Referrer = truncate(v.Referrer, maxReferrerLength)
+	v.ReferrerHost = truncate(v.ReferrerHost, maxColumnLength)
+	v.UTM.Source = truncate(v.UTM.Source, maxColumnLength)
+	v.UTM.Medium = truncate(v.UTM.Medium, maxColumnLength)
+	v.UTM.Campaign = truncate(v.UTM.Campaign, maxColumnLength)
+	v.UTM.Term = truncate(v.UTM.Term, maxColumnLength)
+	v.UTM.Content = truncate(v.UTM.Content, maxColumnLength)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// Once shut down there are no workers left, so write directly
+	if r.closed {
+		return r.writeSync(ctx, v)
+	}
+
+	select {
+	case r.queue <- v:
+		r.enqueued.Add(1)
+		return true
+	default:
+	}
+
+	switch r.opts.Policy {
+	case PolicyBlock:
+		timer := time.NewTimer(r.opts.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case r.queue <- v:
+			r.enqueued.Add(1)
+			return true
+		case <-timer.C:
+		}
+	case PolicySync:
+		return r.writeSync(ctx, v)
+	}
+
+	r.dropped.Add(1)
+	r.logger.Warn("visit queue full, dropping visit", zap.Int("linkId", v.LinkID))
+	return false
+}
+
+// Shutdown stops accepting queued visits and waits for the workers to flush everything already
+// queued. If ctx expires first the workers are stopped, abandoning the visits they have not written,
+// and Shutdown returns once they have exited so the database can be closed safely.
+func (r *Recorder) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		r.logger.Info("visit recorder drained", zap.Int64("written", r.written.Load()))
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		<-done
+		return errors.Join(fmt.Errorf("visit recorder did not drain in time, %d visits were not written", r.abandoned.Load()), ctx.Err())
+	}
+}
+
+// Stats returns a snapshot of the pipeline counters
+func (r *Recorder) Stats() Stats {
+	r.mu.RLock()
+	closed := r.closed
+	r.mu.RUnlock()
+	return Stats{
+		QueueDepth:    len(r.queue),
+		QueueCapacity: cap(r.queue),
+		Policy:        r.opts.Policy,
+		Enqueued:      r.enqueued.Load(),
+		Dropped:       r.dropped.Load(),
+		SyncWrites:    r.syncWrites.Load(),
+		Written:       r.written.Load(),
+		Failed:        r.failed.Load(),
+		Batches:       r.batches.Load(),
+		Abandoned:     r.abandoned.Load(),
+		Closed:        closed,
+	}
+}
+
+// work collects visits into batches, flushing when a batch is full or the flush interval elapses
+func (r *Recorder) work() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Visit, 0, r.opts.BatchSize)
+	for {
+		select {
+		case v, ok := <-r.queue:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, v)
+			if len(batch) >= r.opts.BatchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			r.flush(batch)
+			batch = batch[:0]
+		case <-r.ctx.Done():
+			// Shutdown gave up waiting and has already closed the queue
+			abandoned := len(batch)
+			for range r.queue {
+				abandoned++
+			}
+			r.abandoned.Add(int64(abandoned))
+			return
+		}
+	}
+}
+
+// flush writes a batch. Writes that fail for a reason that may pass, such as a lost connection or
+// a deadlock, are retried with backoff, so a database outage holds visits back rather than losing
+// them. If the batch fails for a lasting reason, for example because one of its links was deleted in
+// the meantime, the visits are written one at a time so a single bad row does not lose the batch.
+func (r *Recorder) flush(batch []Visit) {
+	if len(batch) == 0 {
+		return
+	}
+	r.batches.Add(1)
+
+	ctx, span := tracing.Start(r.ctx, "visit_recorder.flush", attribute.Int("batch.size", len(batch)))
+	defer span.End()
+	logger := tracing.Logger(ctx, r.logger)
+
+	err := r.writeRetrying(ctx, logger, batch)
+	if err == nil {
+		r.written.Add(int64(len(batch)))
+		return
+	}
+	span.RecordError(err)
+	if r.ctx.Err() != nil {
+		r.abandoned.Add(int64(len(batch)))
+		span.SetStatus(codes.Error, "visit recorder stopped")
+		return
+	}
+	if len(batch) == 1 {
+		r.failed.Add(int64(len(batch)))
+		span.SetStatus(codes.Error, "visits could not be written")
+		logger.Error("failed to record visits", zap.Int("size", len(batch)), zap.Error(err))
+		return
+	}
+
+	logger.Warn("failed to write visit batch, writing visits individually", zap.Int("size", len(batch)), zap.Error(err))
+	var failed int
+	for i, v := range batch {
+		err := r.writeRetrying(ctx, logger, []Visit{v})
+		if err != nil && r.ctx.Err() != nil {
+			r.abandoned.Add(int64(len(batch) - i))
+			span.SetStatus(codes.Error, "visit recorder stopped")
+			return
+		}
+		if err != nil {
+			failed++
+			r.failed.Add(1)
+			logger.Error("failed to record visit", zap.Int("linkId", v.LinkID), zap.Error(err))
+			continue
+		}
+		r.written.Add(1)
+	}
+	if failed > 0 {
+		span.SetStatus(codes.Error, "visits could not be written")
+	}
+}
+
+// writeRetrying writes batch, retrying with backoff until it is written, fails for a lasting reason
+// or the recorder is stopped
+func (r *Recorder) writeRetrying(ctx context.Context, logger *zap.Logger, batch []Visit) error {
+	backoff := minRetryBackoff
+	for {
+		err := r.writeBatch(ctx, batch)
+		if err == nil || permanent(err) {
+			return err
+		}
+		logger.Warn("failed to write visits, retrying", zap.Int("size", len(batch)), zap.Duration("backoff", backoff), zap.Error(err))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
+
+// permanent reports whether a write failed for a reason retrying cannot fix: a constraint violation,
+// such as a visit to a link deleted in the meantime, or a value the database rejects
+func permanent(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "22", "23":
+			return true
+		}
+	}
+	return false
+}
+
+// writeSync writes one visit on the caller's goroutine
+func (r *Recorder) writeSync(ctx context.Context, v Visit) bool {
+	r.syncWrites.Add(1)
+	// The visit is still written when the client goes away mid-request
+	ctx, span := tracing.Start(context.WithoutCancel(ctx), "visit_recorder.write")
+	err := r.writeBatch(ctx, []Visit{v})
+	tracing.End(span, err)
+	if err != nil {
+		r.failed.Add(1)
+		tracing.Logger(ctx, r.logger).Error("failed to record visit", zap.Int("linkId", v.LinkID), zap.Error(err))
+		return false
+	}
+	r.written.Add(1)
+	return true
+}
+
+// writeBatch copies the visits into the visits table and increments each link's visits_count
+// by its number of visits, in one transaction
+func (r *Recorder) writeBatch(ctx context.Context, batch []Visit) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("visits", visitColumns...))
+	if err != nil {
+		return err
+	}
+	counts := make(map[int]int)
+	sketches := make(map[visitorid.SketchKey][]int64)
+	for _, v := range batch {
+		row, err := r.row(ctx, v)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, row.values()...); err != nil {
+			stmt.Close()
+			return err
+		}
+		if row.v.IsBot {
+			continue
+		}
+		counts[v.LinkID]++
+		if row.visitorHash.Valid {
+			key := visitorid.SketchKey{LinkID: v.LinkID, Day: visitorid.Day(v.CreatedAt)}
+			sketches[key] = append(sketches[key], row.visitorHash.Int64)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, int64(id))
+	}
+	slices.Sort(ids)
+	increments := make([]int64, len(ids))
+	for i, id := range ids {
+		increments[i] = int64(counts[int(id)])
+	}
+	// The links are locked in id order first, as the update locks them in whatever order its plan
+	// visits them and workers sharing hot links would deadlock. FOR NO KEY UPDATE is the lock the
+	// update takes, which does not block the foreign key checks of concurrent visit inserts.
+	_, err = tx.ExecContext(ctx, `SELECT id FROM links WHERE id = ANY($1::int[]) ORDER BY id FOR NO KEY UPDATE`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE links SET visits_count = links.visits_count + c.n
+		FROM (SELECT unnest($1::int[]) AS id, unnest($2::int[]) AS n) c
+		WHERE links.id = c.id`, pq.Array(ids), pq.Array(increments))
+	if err != nil {
+		return err
+	}
+	if err := visitorid.UpdateSketches(ctx, tx, sketches); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// truncate shortens s to at most n characters without splitting a multi-byte character
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
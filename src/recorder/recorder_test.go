@@ -0,0 +1,63 @@
+package recorder
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"foreign key violation", &pq.Error{Code: "23503"}, true},
+		{"wrapped foreign key violation", fmt.Errorf("insert visits: %w", &pq.Error{Code: "23503"}), true},
+		{"invalid text representation", &pq.Error{Code: "22P02"}, true},
+		{"serialization failure", &pq.Error{Code: "40001"}, false},
+		{"deadlock", &pq.Error{Code: "40P01"}, false},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, false},
+		{"connection error", errors.New("dial tcp: connection refused"), false},
+		{"deadline", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permanent(tt.err); got != tt.want {
+				t.Errorf("permanent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShutdownAbandonsUnwrittenVisits(t *testing.T) {
+	// Nothing listens on port 1, so every write fails with a connection error and is retried
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	defer db.Close()
+
+	r := New(db, Options{QueueSize: 10, Workers: 1, BatchSize: 2, FlushInterval: time.Millisecond, Policy: PolicyDrop}, nil, nil)
+	r.Start()
+	for i := 0; i < 5; i++ {
+		if !r.Record(context.Background(), Visit{LinkID: i + 1}) {
+			t.Fatalf("Record() dropped visit %d", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx); err == nil {
+		t.Fatal("Shutdown() error = nil, want a drain timeout")
+	}
+	stats := r.Stats()
+	if stats.Abandoned != 5 || stats.Written != 0 || stats.Failed != 0 {
+		t.Errorf("Stats() = %+v, want 5 abandoned visits", stats)
+	}
+}
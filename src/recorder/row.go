@@ -0,0 +1,91 @@
+package recorder
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/privacy"
+	"shurl/src/useragent"
+)
+
+// visitColumns are the visits columns written by COPY, in the order of visitRow.values
+var visitColumns = []string{
+	"link_id", "ip_address", "ip_mode", "user_agent", "referrer", "source", "created_at", "anonymous", "is_bot",
+	"browser", "browser_version", "os", "os_version", "device_type", "bot_name",
+	"country", "region", "city", "asn", "as_org",
+	"referrer_host", "referrer_class", "utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content",
+	"visitor_hash",
+}
+
+// visitRow is a visit as written to the visits table
+type visitRow struct {
+	v           Visit
+	ipAddress   sql.NullString
+	ipMode      privacy.Mode
+	anonymous   bool
+	ua          useragent.Info
+	country     sql.NullString
+	region      sql.NullString
+	city        sql.NullString
+	asn         sql.NullInt64
+	asOrg       sql.NullString
+	visitorHash sql.NullInt64
+}
+
+// row enriches a visit and applies the privacy options to it. Visitors who asked not to be
+// tracked are stored as an anonymous count: only the link, time, source and bot flag are kept.
+func (r *Recorder) row(ctx context.Context, v Visit) (visitRow, error) {
+	row := visitRow{v: v}
+	if v.DoNotTrack && r.opts.Privacy.HonorDoNotTrack {
+		row.anonymous = true
+		row.ipMode = privacy.ModeNone
+		return row, nil
+	}
+
+	row.ua = useragent.Parse(v.UserAgent)
+
+	// The location and visitor hash are derived from the raw address before it is anonymized
+	loc := r.geo.Lookup(v.IPAddress)
+	row.country = nullString(loc.Country)
+	row.region = nullString(truncate(loc.Region, 128))
+	row.city = nullString(truncate(loc.City, 128))
+	row.asn = sql.NullInt64{Int64: int64(loc.ASN), Valid: loc.ASN != 0}
+	row.asOrg = nullString(truncate(loc.ASOrg, maxColumnLength))
+
+	hash, err := r.visitors.Hash(ctx, v.LinkID, v.IPAddress, v.UserAgent, v.CreatedAt)
+	if err != nil {
+		return row, err
+	}
+	row.visitorHash = sql.NullInt64{Int64: hash, Valid: true}
+
+	ip, _ := r.opts.Privacy.Anonymize(v.IPAddress, privacy.ModeFull)
+	row.ipAddress = nullString(ip)
+	row.ipMode = r.opts.Privacy.Mode
+	return row, nil
+}
+
+func (row visitRow) values() []any {
+	v := row.v
+	if row.anonymous {
+		return []any{
+			v.LinkID, nil, string(row.ipMode), nil, nil, v.Source, v.CreatedAt, true, v.IsBot,
+			nil, nil, nil, nil, nil, nil,
+			nil, nil, nil, nil, nil,
+			nil, nil, nil, nil, nil, nil, nil,
+			nil,
+		}
+	}
+	return []any{
+		v.LinkID, row.ipAddress, string(row.ipMode), v.UserAgent, v.Referrer, v.Source, v.CreatedAt, false, v.IsBot,
+		nullString(row.ua.Browser), nullString(row.ua.BrowserVersion), nullString(row.ua.OS), nullString(row.ua.OSVersion),
+		row.ua.DeviceType, nullString(row.ua.BotName),
+		row.country, row.region, row.city, row.asn, row.asOrg,
+		nullString(v.ReferrerHost), nullString(v.ReferrerClass), nullString(v.UTM.Source), nullString(v.UTM.Medium),
+		nullString(v.UTM.Campaign), nullString(v.UTM.Term), nullString(v.UTM.Content),
+		row.visitorHash,
+	}
+}
+
+// nullString stores empty values as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
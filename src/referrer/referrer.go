@@ -0,0 +1,228 @@
+package referrer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"shurl/src/config"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Source classes a visit can be attributed to
+const (
+	ClassDirect   = "direct"
+	ClassSearch   = "search"
+	ClassSocial   = "social"
+	ClassEmail    = "email"
+	ClassInternal = "internal"
+	ClassOther    = "other"
+)
+
+// Rules lists, per class, the referrer hosts that belong to it. An entry matches the host itself and
+// its subdomains; an entry ending in ".*" matches any suffix, so "google.*" covers google.com and
+// www.google.co.uk. Mediums maps lower-cased utm_medium values to a class, used when the referrer
+// alone does not tell where a visit came from.
+type Rules struct {
+	Search   []string          `json:"search"`
+	Social   []string          `json:"social"`
+	Email    []string          `json:"email"`
+	Internal []string          `json:"internal"`
+	Mediums  map[string]string `json:"mediums"`
+}
+
+// DefaultRules cover the most common search engines, social networks and webmail clients
+var DefaultRules = Rules{
+	Search: []string{
+		"google.*", "bing.com", "duckduckgo.com", "yahoo.*", "yandex.*", "baidu.com", "ecosia.org",
+		"search.brave.com", "startpage.com", "qwant.com", "naver.com", "kagi.com",
+	},
+	Social: []string{
+		"facebook.com", "fb.com", "fb.me", "messenger.com", "instagram.com", "twitter.com", "x.com", "t.co",
+		"linkedin.com", "lnkd.in", "reddit.com", "pinterest.*", "tiktok.com", "youtube.com", "youtu.be",
+		"threads.net", "bsky.app", "mastodon.social", "t.me", "web.telegram.org", "whatsapp.com",
+		"discord.com", "news.ycombinator.com", "quora.com", "vk.com", "weibo.com",
+		"com.linkedin.android", "com.twitter.android", "com.facebook.katana", "org.telegram.messenger",
+	},
+	Email: []string{
+		"mail.google.com", "outlook.live.com", "outlook.office.com", "outlook.office365.com", "mail.yahoo.com",
+		"mail.proton.me", "mail.aol.com", "mail.yandex.ru", "fastmail.com", "icloud.com",
+		"com.google.android.gm", "com.microsoft.office.outlook",
+	},
+	Mediums: map[string]string{
+		"email":        ClassEmail,
+		"e-mail":       ClassEmail,
+		"newsletter":   ClassEmail,
+		"social":       ClassSocial,
+		"social-media": ClassSocial,
+	},
+}
+
+// Result is the parsed form of a visit's referrer
+type Result struct {
+	// Host is the lower-cased referrer host without "www.", empty for direct visits
+	Host  string
+	Class string
+}
+
+// Classifier attributes visits to a source class
+type Classifier struct {
+	rules Rules
+	// internal hosts come from the rules and from BASE_URL
+	internal []string
+}
+
+// NewClassifier builds a classifier from rules. Hosts in internalHosts are classified as internal
+// in addition to the rules' own internal list.
+func NewClassifier(rules Rules, internalHosts ...string) *Classifier {
+	c := &Classifier{rules: rules}
+	for _, host := range append(append([]string{}, rules.Internal...), internalHosts...) {
+		if host = normalizeHost(host); host != "" {
+			c.internal = append(c.internal, host)
+		}
+	}
+	return c
+}
+
+// ClassifierFromEnv builds a classifier from DefaultRules, overridden class by class by the JSON file
+// named by REFERRER_RULES_FILE. The host of BASE_URL and the comma-separated REFERRER_INTERNAL_HOSTS
+// count as internal. A rules file that cannot be read is logged and the defaults are used.
+func ClassifierFromEnv() *Classifier {
+	rules := DefaultRules
+	if path := os.Getenv("REFERRER_RULES_FILE"); path != "" {
+		loaded, err := LoadRules(path)
+		if err != nil {
+			config.GetLogger().Error("failed to load referrer rules, using defaults", zap.String("path", path), zap.Error(err))
+		} else {
+			rules = rules.Merge(loaded)
+		}
+	}
+
+	var internal []string
+	if base, err := url.Parse(os.Getenv("BASE_URL")); err == nil && base.Host != "" {
+		internal = append(internal, base.Host)
+	}
+	for _, host := range strings.Split(os.Getenv("REFERRER_INTERNAL_HOSTS"), ",") {
+		internal = append(internal, strings.TrimSpace(host))
+	}
+	return NewClassifier(rules, internal...)
+}
+
+// LoadRules reads rules from a JSON file
+func LoadRules(path string) (Rules, error) {
+	var rules Rules
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("invalid referrer rules: %w", err)
+	}
+	for medium, class := range rules.Mediums {
+		switch class {
+		case ClassDirect, ClassSearch, ClassSocial, ClassEmail, ClassInternal, ClassOther:
+		default:
+			return rules, fmt.Errorf("invalid class %q for medium %q", class, medium)
+		}
+	}
+	return rules, nil
+}
+
+// Merge returns r with every list set in override replacing the corresponding list of r
+func (r Rules) Merge(override Rules) Rules {
+	if override.Search != nil {
+		r.Search = override.Search
+	}
+	if override.Social != nil {
+		r.Social = override.Social
+	}
+	if override.Email != nil {
+		r.Email = override.Email
+	}
+	if override.Internal != nil {
+		r.Internal = override.Internal
+	}
+	if override.Mediums != nil {
+		r.Mediums = override.Mediums
+	}
+	return r
+}
+
+// Classify parses the raw Referer header of a visit and attributes the visit to a class.
+// requestHost is the host the short link was requested on, which counts as internal;
+// medium is the utm_medium of the request, consulted when the referrer is missing or unknown.
+func (c *Classifier) Classify(rawReferrer, medium, requestHost string) Result {
+	result := Result{Host: Host(rawReferrer), Class: ClassOther}
+
+	switch {
+	case result.Host == "":
+		result.Class = ClassDirect
+	case c.isInternal(result.Host, requestHost):
+		result.Class = ClassInternal
+	// Webmail often lives on a search engine's domain, such as mail.google.com, so it is checked first
+	case matchAny(result.Host, c.rules.Email):
+		result.Class = ClassEmail
+	case matchAny(result.Host, c.rules.Social):
+		result.Class = ClassSocial
+	case matchAny(result.Host, c.rules.Search):
+		result.Class = ClassSearch
+	}
+
+	if result.Class == ClassDirect || result.Class == ClassOther {
+		if class, ok := c.rules.Mediums[strings.ToLower(strings.TrimSpace(medium))]; ok {
+			result.Class = class
+		}
+	}
+	return result
+}
+
+func (c *Classifier) isInternal(host, requestHost string) bool {
+	if requestHost = normalizeHost(requestHost); requestHost != "" && host == requestHost {
+		return true
+	}
+	return matchAny(host, c.internal)
+}
+
+// Host returns the normalized host of a referrer URL. App referrers such as
+// android-app://com.google.android.gm yield the package name.
+func Host(rawReferrer string) string {
+	rawReferrer = strings.TrimSpace(rawReferrer)
+	if rawReferrer == "" {
+		return ""
+	}
+	u, err := url.Parse(rawReferrer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return normalizeHost(u.Host)
+}
+
+// normalizeHost lower-cases host and strips the port and a leading "www."
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimPrefix(strings.TrimSuffix(host, "."), "www.")
+}
+
+func matchAny(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if match(host, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether host is pattern or one of its subdomains. A trailing ".*" in pattern
+// stands for any suffix.
+func match(host, pattern string) bool {
+	if base, ok := strings.CutSuffix(pattern, ".*"); ok {
+		return strings.HasPrefix(host, base+".") || strings.Contains(host, "."+base+".")
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
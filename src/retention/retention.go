@@ -0,0 +1,153 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"shurl/src/config"
+	"shurl/src/jobs"
+	"shurl/src/tracing"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// Options configures the retention policy
+type Options struct {
+	// Days is how many days of raw visits are kept, counting today; zero keeps visits forever
+	Days int
+	// Interval is how often visits past the retention period are rolled up
+	Interval time.Duration
+}
+
+// OptionsFromEnv reads the retention options from VISIT_RETENTION_DAYS and VISIT_ROLLUP_INTERVAL
+func OptionsFromEnv() Options {
+	return Options{
+		Days:     config.GetEnvInt("VISIT_RETENTION_DAYS", 0),
+		Interval: config.GetEnvDuration("VISIT_ROLLUP_INTERVAL", time.Hour),
+	}
+}
+
+// Cutoff is the start of the oldest UTC day whose raw visits are kept at now
+func (o Options) Cutoff(now time.Time) time.Time {
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-o.Days)
+}
+
+// Stats is a snapshot of the rollup scheduler state
+type Stats struct {
+	Enabled       bool       `json:"enabled"`
+	RetentionDays int        `json:"retention_days"`
+	Running       bool       `json:"running"`
+	Runs          int64      `json:"runs"`
+	Failures      int64      `json:"failures"`
+	DaysRolledUp  int64      `json:"days_rolled_up"`
+	LastRunAt     *time.Time `json:"last_run_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Scheduler periodically rolls visits older than the retention period into daily rollups.
+// A disabled scheduler does nothing.
+type Scheduler struct {
+	db     *sql.DB
+	opts   Options
+	logger *zap.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	running  atomic.Bool
+	runs     atomic.Int64
+	failures atomic.Int64
+	days     atomic.Int64
+
+	// mu guards the outcome of the last run
+	mu        sync.Mutex
+	lastRunAt *time.Time
+	lastError string
+}
+
+// New creates a scheduler; call Start to run it
+func New(db *sql.DB, opts Options) *Scheduler {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{db: db, opts: opts, logger: config.GetLogger(), ctx: ctx, cancel: cancel}
+}
+
+// Enabled reports whether a retention period is configured
+func (s *Scheduler) Enabled() bool {
+	return s.opts.Days > 0
+}
+
+// Start runs a rollup immediately and then every Interval
+func (s *Scheduler) Start() {
+	if !s.Enabled() {
+		s.logger.Info("visit retention disabled, VISIT_RETENTION_DAYS is not set")
+		return
+	}
+	s.wg.Add(1)
+	go s.loop()
+}
+
+// Close stops the scheduler, interrupting a rollup in progress between two days
+func (s *Scheduler) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Stats returns a snapshot of the scheduler state
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{
+		Enabled:       s.Enabled(),
+		RetentionDays: s.opts.Days,
+		Running:       s.running.Load(),
+		Runs:          s.runs.Load(),
+		Failures:      s.failures.Load(),
+		DaysRolledUp:  s.days.Load(),
+		LastRunAt:     s.lastRunAt,
+		LastError:     s.lastError,
+	}
+}
+
+func (s *Scheduler) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+	for {
+		s.run()
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) run() {
+	s.running.Store(true)
+	defer s.running.Store(false)
+
+	now := time.Now().UTC()
+	ctx, span := tracing.Start(s.ctx, "visit_rollups.run")
+	logger := tracing.Logger(ctx, s.logger)
+	days, err := jobs.RollupVisits(ctx, s.db, logger, s.opts.Cutoff(now))
+	span.SetAttributes(attribute.Int("days", days))
+	tracing.End(span, err)
+	s.runs.Add(1)
+	s.days.Add(int64(days))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRunAt, s.lastError = &now, ""
+	if err != nil && s.ctx.Err() == nil {
+		s.failures.Add(1)
+		s.lastError = err.Error()
+		logger.Error("failed to roll up visits", zap.Int("days", days), zap.Error(err))
+	}
+}
@@ -2,17 +2,31 @@ package routes
 
 import (
 	"database/sql"
+	"shurl/src/anomaly"
+	"shurl/src/botdetect"
+	"shurl/src/config"
+	"shurl/src/geoip"
 	"shurl/src/handlers"
+	"shurl/src/linkcache"
+	"shurl/src/metrics"
 	"shurl/src/middlewares"
+	"shurl/src/recorder"
+	"shurl/src/referrer"
+	"shurl/src/retention"
+	"shurl/src/visitfeed"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
 // SetupRoutes configures all the routes for the application
-func SetupRoutes(router *gin.Engine, db *sql.DB, logger *zap.Logger) {
-	// Set logger for handlers
-	handlers.SetLogger(logger)
+func SetupRoutes(router *gin.Engine, db *sql.DB, logger *zap.Logger, rec *recorder.Recorder, cache *linkcache.Cache, geo *geoip.Enricher, rollups *retention.Scheduler, feed *visitfeed.Hub, anomalies *anomaly.Detector) {
+	// Requests are traced, logged with an ID and measured by route; panics are logged and answered
+	// with a 500. Middleware must be added before the routes
+	router.Use(middlewares.Tracing(), middlewares.RequestLogger(logger), middlewares.Recovery(), metrics.Middleware())
+	metrics.RegisterDB(db)
+	metrics.RegisterRecorder(rec)
+	metrics.RegisterCache(cache)
 
 	// Static files
 	router.Static("/static", "./src/static")
@@ -24,15 +38,65 @@ func SetupRoutes(router *gin.Engine, db *sql.DB, logger *zap.Logger) {
 		// Page routes
 		protected.GET("/", handlers.HandleIndex)
 		protected.GET("/links/visits/:id", handlers.HandleVisitDetails(db))
+		protected.GET("/dashboard", handlers.HandleDashboard)
 
 		// API routes
-		protected.POST("/api/generate", handlers.HandleGenerateLink(db))
+		protected.POST("/api/generate", handlers.HandleGenerateLink(db, cache))
 		protected.GET("/api/links", handlers.HandleListLinks(db))
 		protected.GET("/api/links/visits/:id", handlers.HandleLinkVisits(db))
-		protected.DELETE("/api/links/:id", handlers.HandleDeleteLink(db))
+		protected.GET("/api/links/:id/visits/stream", handlers.HandleLinkVisitStream(db, feed))
+		protected.GET("/api/visits/stream", handlers.HandleVisitStream(feed))
+		protected.GET("/api/links/:id/visits/export", handlers.HandleLinkVisitExport(db))
+		protected.GET("/api/visits/export", handlers.HandleVisitExport(db))
+		protected.GET("/api/links/:id/qr", handlers.HandleLinkQR(db))
+		protected.PUT("/api/links/:id", handlers.HandleUpdateLink(db, cache))
+		protected.DELETE("/api/links/:id", handlers.HandleDeleteLink(db, cache))
+		protected.GET("/api/utm-presets", handlers.HandleListUTMPresets(db))
+		protected.POST("/api/utm-presets", handlers.HandleCreateUTMPreset(db))
+		protected.PUT("/api/utm-presets/:id", handlers.HandleUpdateUTMPreset(db))
+		protected.DELETE("/api/utm-presets/:id", handlers.HandleDeleteUTMPreset(db))
+		protected.GET("/api/stats", handlers.HandleGlobalStats(db))
+		protected.GET("/api/stats/campaigns", handlers.HandleCampaignStats(db))
+		protected.GET("/api/stats/referrers", handlers.HandleTopReferrers(db))
+		protected.GET("/api/stats/sources", handlers.HandleTopSources(db))
+		protected.GET("/api/stats/links", handlers.HandleTopLinks(db))
+		protected.GET("/api/stats/summary", handlers.HandleLinkSummary(db))
+		protected.GET("/api/stats/breakdown/:dimension", handlers.HandleBreakdown(db))
+		protected.GET("/api/stats/compare", handlers.HandleComparison(db))
+		protected.GET("/api/stats/trending", handlers.HandleTrendingLinks(db))
+		protected.GET("/api/anomalies", handlers.HandleAnomalies(db))
+		protected.GET("/api/links/:id/stats", handlers.HandleLinkStats(db))
+		protected.GET("/api/links/:id/stats/compare", handlers.HandleLinkComparison(db))
+		protected.GET("/api/links/:id/anomalies", handlers.HandleLinkAnomalies(db))
+		protected.GET("/api/links/:id/breakdown/:dimension", handlers.HandleLinkBreakdown(db))
+		protected.GET("/api/links/:id/referrers", handlers.HandleLinkTopReferrers(db))
+		protected.GET("/api/links/:id/sources", handlers.HandleLinkTopSources(db))
+		protected.GET("/api/pixels", handlers.HandleListPixels(db))
+		protected.POST("/api/pixels", handlers.HandleCreatePixel(db))
+		protected.PUT("/api/pixels/:id", handlers.HandleUpdatePixel(db, cache))
+		protected.DELETE("/api/pixels/:id", handlers.HandleDeletePixel(db, cache))
+		protected.GET("/api/links/:id/pixels", handlers.HandleLinkPixels(db))
+		protected.PUT("/api/links/:id/pixels", handlers.HandleSetLinkPixels(db, cache))
+		protected.GET("/api/system/stats", handlers.HandleSystemStats(rec, cache, geo, rollups, feed, anomalies))
 	}
 
+	// Liveness and readiness probes, registered ahead of the short code routes
+	router.GET("/healthz", handlers.HandleHealthz)
+	router.GET("/readyz", handlers.HandleReadyz(db, rec, cache, geo, rollups, anomalies))
+
+	// Prometheus metrics, guarded by their own credentials and allow-list
+	router.GET("/metrics", middlewares.MetricsAuth(), gin.WrapH(metrics.Handler()))
+
+	// App association files for universal links and Android app links
+	appLinks := config.GetAppLinks()
+	router.GET("/.well-known/apple-app-site-association", handlers.HandleAppleAppSiteAssociation(appLinks))
+	router.GET("/.well-known/assetlinks.json", handlers.HandleAssetLinks(appLinks))
+
 	// Redirect route - must be last to avoid conflicts with other routes
 	// Not protected by authentication
-	router.GET("/:code", handlers.HandleRedirect(db))
+	router.GET("/:code/qr", handlers.HandleCodeQR(cache))
+	// HEAD is answered too, so uptime monitors get the redirect and are recorded as bots
+	redirect := handlers.HandleRedirect(cache, rec, feed, referrer.ClassifierFromEnv(), botdetect.FromEnv())
+	router.GET("/:code", redirect)
+	router.HEAD("/:code", redirect)
 }
@@ -33,6 +33,131 @@ function formatDateTimeLocal(date) {
   return `${day}-${month}-${year} ${displayHour}:${minutes}:${seconds} ${ampm}`;
 }
 
+// Draws a bar chart of a stats series ({bucket, visits}) into container as an SVG.
+// Each bar carries its bucket and count as a tooltip.
+function renderBarChart(container, points, labelFormat) {
+  container.innerHTML = '';
+  if (!points || points.length === 0) {
+    container.textContent = 'No visits in this range.';
+    return;
+  }
+  const width = 800, height = 200, gap = points.length > 60 ? 0 : 2;
+  const max = Math.max(1, ...points.map(p => p.visits));
+  const barWidth = width / points.length;
+  const ns = 'http://www.w3.org/2000/svg';
+  const svg = document.createElementNS(ns, 'svg');
+  svg.setAttribute('viewBox', `0 0 ${width} ${height}`);
+  svg.setAttribute('preserveAspectRatio', 'none');
+  svg.setAttribute('class', 'w-full h-48');
+  points.forEach((point, i) => {
+    const barHeight = point.visits / max * (height - 4);
+    const rect = document.createElementNS(ns, 'rect');
+    rect.setAttribute('x', i * barWidth + gap / 2);
+    rect.setAttribute('y', height - barHeight);
+    rect.setAttribute('width', Math.max(barWidth - gap, 1));
+    rect.setAttribute('height', barHeight);
+    rect.setAttribute('class', 'fill-indigo-500 hover:fill-indigo-400');
+    const title = document.createElementNS(ns, 'title');
+    const date = new Date(point.bucket);
+    title.textContent = `${labelFormat ? labelFormat(date) : date.toLocaleDateString()}: ${point.visits.toLocaleString()} visits`;
+    rect.appendChild(title);
+    svg.appendChild(rect);
+  });
+  container.appendChild(svg);
+
+  const axis = document.createElement('div');
+  axis.className = 'flex justify-between text-xs text-gray-500 dark:text-gray-400 mt-1';
+  [points[0], points[points.length - 1]].forEach(point => {
+    const span = document.createElement('span');
+    const date = new Date(point.bucket);
+    span.textContent = labelFormat ? labelFormat(date) : date.toLocaleDateString();
+    axis.appendChild(span);
+  });
+  container.appendChild(axis);
+}
+
+// Fills container with one row per entry: its label, a bar scaled to the largest entry and its count.
+// When onSelect is given, clicking a row calls it with the entry.
+function renderBreakdown(container, entries, label, onSelect) {
+  container.innerHTML = '';
+  if (!entries || entries.length === 0) {
+    container.innerHTML = '<p class="text-sm text-gray-500 dark:text-gray-400">No visits in this range.</p>';
+    return;
+  }
+  const max = Math.max(...entries.map(e => e.visits));
+  entries.forEach(entry => {
+    const row = document.createElement('div');
+    row.className = 'flex items-center py-1 text-sm';
+    const name = document.createElement('span');
+    name.className = 'w-40 pr-4 truncate text-gray-900 dark:text-gray-100';
+    name.textContent = label ? label(entry) : entry.value;
+    name.title = name.textContent;
+    const track = document.createElement('div');
+    track.className = 'flex-1 h-2 rounded-full bg-gray-100 dark:bg-dark-300';
+    const bar = document.createElement('div');
+    bar.className = 'h-2 rounded-full bg-indigo-500';
+    bar.style.width = (entry.visits / max * 100) + '%';
+    track.appendChild(bar);
+    const count = document.createElement('span');
+    count.className = 'w-20 pl-4 text-right text-gray-500 dark:text-gray-400';
+    count.textContent = entry.visits.toLocaleString();
+    row.append(name, track, count);
+    if (onSelect) {
+      row.classList.add('cursor-pointer', 'hover:bg-gray-50', 'dark:hover:bg-dark-300');
+      row.title = 'Show only these visits';
+      row.addEventListener('click', () => onSelect(entry));
+    }
+    container.appendChild(row);
+  });
+}
+// Formats a percent change from the comparison endpoints; a null change had nothing to compare with
+function formatChange(change) {
+  if (change === null || change === undefined) return 'new';
+  return (change > 0 ? '+' : '') + change.toLocaleString() + '%';
+}
+
+// Fills element with a percent change versus the previous period, colored by its direction
+function renderChange(element, change) {
+  element.textContent = `${formatChange(change)} vs previous period`;
+  element.classList.remove('text-green-600', 'dark:text-green-400', 'text-red-600', 'dark:text-red-400');
+  if (change > 0) {
+    element.classList.add('text-green-600', 'dark:text-green-400');
+  } else if (change < 0) {
+    element.classList.add('text-red-600', 'dark:text-red-400');
+  }
+}
+
+// Lists flagged spikes and drops in container, with links to their visit pages when withLinks is set
+function renderAnomalies(container, anomalies, withLinks) {
+  container.innerHTML = '';
+  if (!anomalies || anomalies.length === 0) {
+    container.innerHTML = '<p class="text-sm text-gray-500 dark:text-gray-400">No spikes or drops in this range.</p>';
+    return;
+  }
+  anomalies.forEach(anomaly => {
+    const row = document.createElement('div');
+    row.className = 'flex flex-wrap items-center gap-2 py-1 text-sm';
+    const badge = document.createElement('span');
+    badge.className = 'px-2 py-1 text-xs font-medium rounded-full ' + (anomaly.kind === 'spike'
+      ? 'bg-green-100 text-green-800 dark:bg-green-900 dark:text-green-200'
+      : 'bg-red-100 text-red-800 dark:bg-red-900 dark:text-red-200');
+    badge.textContent = anomaly.kind === 'spike' ? 'Spike' : 'Drop';
+    row.appendChild(badge);
+    if (withLinks) {
+      const link = document.createElement('a');
+      link.href = `/links/visits/${anomaly.link_id}`;
+      link.className = 'text-indigo-600 dark:text-indigo-400 hover:underline';
+      link.textContent = anomaly.code;
+      row.appendChild(link);
+    }
+    const detail = document.createElement('span');
+    detail.className = 'text-gray-500 dark:text-gray-400';
+    detail.textContent = `${anomaly.visits.toLocaleString()} visits at ${formatDateTimeLocal(new Date(anomaly.bucket))}, ` +
+      `usually ${anomaly.baseline.toLocaleString(undefined, { maximumFractionDigits: 1 })} per hour`;
+    row.appendChild(detail);
+    container.appendChild(row);
+  });
+}
 
 // Delete confirmation handling
 let linkToDeleteId = null;
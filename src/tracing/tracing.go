@@ -0,0 +1,143 @@
+// Package tracing sets up OpenTelemetry tracing: the exporter, the W3C trace context propagator and
+// helpers for the spans of background jobs and for carrying trace IDs into logs
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"shurl/src/config"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// ServiceName is the service.name of the spans, unless OTEL_SERVICE_NAME is set
+const ServiceName = "shurl"
+
+// tracer creates the spans of the application's own operations; HTTP and SQL spans come from their
+// instrumentation libraries
+var tracer = otel.Tracer("shurl")
+
+// Exporters
+const (
+	// ExporterNone records no spans, but trace context is still propagated and logged
+	ExporterNone = "none"
+	// ExporterOTLP sends spans over OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes spans to stdout as JSON, for local debugging
+	ExporterStdout = "stdout"
+)
+
+// Options configures tracing
+type Options struct {
+	Exporter string
+	// SampleRatio is the share of traces started here that are recorded; a trace continued from an
+	// incoming request follows the sampling decision of its caller
+	SampleRatio float64
+}
+
+// OptionsFromEnv reads the tracing options from TRACING_EXPORTER and TRACING_SAMPLE_RATIO
+func OptionsFromEnv() Options {
+	exporter := strings.ToLower(os.Getenv("TRACING_EXPORTER"))
+	if exporter == "" {
+		exporter = ExporterNone
+	}
+	return Options{
+		Exporter:    exporter,
+		SampleRatio: config.GetEnvFloat("TRACING_SAMPLE_RATIO", 1),
+	}
+}
+
+// Provider owns the tracer provider, which batches spans to the exporter
+type Provider struct {
+	tp *sdktrace.TracerProvider
+}
+
+// New installs the W3C trace context and baggage propagators and, unless the exporter is none, a
+// global tracer provider exporting spans with the configured exporter
+func New(ctx context.Context, opts Options) (*Provider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case ExporterNone:
+		return &Provider{}, nil
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("invalid TRACING_EXPORTER %q, expected none, otlp or stdout", opts.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return &Provider{tp: tp}, nil
+}
+
+// Enabled reports whether spans are exported
+func (p *Provider) Enabled() bool {
+	return p.tp != nil
+}
+
+// Shutdown exports the spans still buffered and stops the exporter
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.tp == nil {
+		return nil
+	}
+	return p.tp.Shutdown(ctx)
+}
+
+// Start starts a span for an operation of the application, such as a background job
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End marks span as failed when err is set, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Logger annotates logger with the trace and span IDs of the span in ctx, so log lines can be
+// matched with their trace. logger is returned as is when ctx carries no span.
+func Logger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return logger
+	}
+	return logger.With(zap.String("trace_id", sc.TraceID().String()), zap.String("span_id", sc.SpanID().String()))
+}
@@ -0,0 +1,177 @@
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device types returned by Parse
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// Info is the structured form of a user-agent string
+type Info struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	DeviceType     string
+	// BotName is set when DeviceType is DeviceBot
+	BotName string
+}
+
+type pattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// botPatterns name well-known automated clients
+var botPatterns = []pattern{
+	{"Googlebot", regexp.MustCompile(`Googlebot(?:-\w+)?/([\d.]+)`)},
+	{"Bingbot", regexp.MustCompile(`bingbot/([\d.]+)`)},
+	{"DuckDuckBot", regexp.MustCompile(`DuckDuckBot(?:-\w+)?/([\d.]+)`)},
+	{"YandexBot", regexp.MustCompile(`YandexBot/([\d.]+)`)},
+	{"Baiduspider", regexp.MustCompile(`Baiduspider(?:-\w+)?/([\d.]+)`)},
+	{"Facebook", regexp.MustCompile(`facebookexternalhit/([\d.]+)|Facebot`)},
+	{"Twitterbot", regexp.MustCompile(`Twitterbot/([\d.]+)`)},
+	{"Slackbot", regexp.MustCompile(`Slackbot(?:-LinkExpanding)?(?: ([\d.]+))?`)},
+	{"LinkedInBot", regexp.MustCompile(`LinkedInBot/([\d.]+)`)},
+	{"Discordbot", regexp.MustCompile(`Discordbot/([\d.]+)`)},
+	{"TelegramBot", regexp.MustCompile(`TelegramBot`)},
+	// WhatsApp's in-app browser also has WhatsApp/, but not at the start
+	{"WhatsApp", regexp.MustCompile(`^WhatsApp/([\d.]+)`)},
+	{"Snapchat", regexp.MustCompile(`Snap URL Preview Service`)},
+	{"Applebot", regexp.MustCompile(`Applebot/([\d.]+)`)},
+	{"curl", regexp.MustCompile(`^curl/([\d.]+)`)},
+	{"Wget", regexp.MustCompile(`^Wget/([\d.]+)`)},
+	{"python-requests", regexp.MustCompile(`python-requests/([\d.]+)`)},
+	{"Go-http-client", regexp.MustCompile(`Go-http-client/([\d.]+)`)},
+	{"HeadlessChrome", regexp.MustCompile(`HeadlessChrome/([\d.]+)`)},
+}
+
+// genericBots match the self-descriptions most other crawlers use: a product token such as
+// AhrefsBot/7.0, or a name in a "compatible;" comment such as (compatible; Bytespider; ...). The
+// keyword must end the name, so device models like CUBOT_X30 or Robot-X are not mistaken for bots.
+var genericBots = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(?:^|[\s;(,+])([\w.-]*(?:bot|crawler|spider|scraper|monitor|preview))/`),
+	regexp.MustCompile(`(?i)compatible;\s*\+?([\w.-]*(?:bot|crawler|spider|scraper|monitor|preview))(?:[\s;)]|$)`),
+}
+
+// browserPatterns are checked in order, since most browsers also claim to be Chrome, Safari or Mozilla
+var browserPatterns = []pattern{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera|OPiOS)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Yandex Browser", regexp.MustCompile(`YaBrowser/([\d.]+)`)},
+	{"Vivaldi", regexp.MustCompile(`Vivaldi/([\d.]+)`)},
+	{"UC Browser", regexp.MustCompile(`UCBrowser/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+	{"Internet Explorer", regexp.MustCompile(`MSIE ([\d.]+)|Trident/.*rv:([\d.]+)`)},
+}
+
+var osPatterns = []pattern{
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|CPU) OS ([\d_]+)`)},
+	{"iPadOS", regexp.MustCompile(`iPad.*OS ([\d_]+)`)},
+	{"Android", regexp.MustCompile(`Android ([\d.]+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X ([\d_.]+)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"Linux", regexp.MustCompile(`Linux`)},
+}
+
+// windowsVersions maps Windows NT kernel versions to marketing names
+var windowsVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+// Parse extracts the browser, operating system and device type from a user-agent string
+func Parse(ua string) Info {
+	var info Info
+
+	if name, _, ok := matchFirst(botPatterns, ua); ok {
+		info.BotName = name
+	} else if name, ok := matchGenericBot(ua); ok {
+		info.BotName = name
+	} else if strings.TrimSpace(ua) == "" {
+		info.BotName = "Unknown"
+	}
+
+	if name, version, ok := matchFirst(browserPatterns, ua); ok && info.BotName == "" {
+		info.Browser, info.BrowserVersion = name, version
+	}
+
+	// iPads and iPhones share the "CPU OS" token, so iPadOS is told apart by the device name
+	osList := osPatterns
+	if strings.Contains(ua, "iPad") {
+		osList = []pattern{osPatterns[2]}
+	}
+	if name, version, ok := matchFirst(osList, ua); ok {
+		info.OS, info.OSVersion = name, strings.ReplaceAll(version, "_", ".")
+		if name == "Windows" {
+			if marketing, ok := windowsVersions[version]; ok {
+				info.OSVersion = marketing
+			}
+		}
+	}
+
+	info.DeviceType = deviceType(ua, info)
+	return info
+}
+
+// IsBot reports whether the user agent belongs to an automated client
+func IsBot(ua string) bool {
+	return Parse(ua).DeviceType == DeviceBot
+}
+
+func deviceType(ua string, info Info) string {
+	lower := strings.ToLower(ua)
+	switch {
+	case info.BotName != "":
+		return DeviceBot
+	case strings.Contains(lower, "ipad"), strings.Contains(lower, "tablet"),
+		info.OS == "Android" && !strings.Contains(lower, "mobile"):
+		return DeviceTablet
+	case strings.Contains(lower, "mobi"), strings.Contains(lower, "iphone"), strings.Contains(lower, "ipod"):
+		return DeviceMobile
+	}
+	return DeviceDesktop
+}
+
+// matchGenericBot returns the name a crawler not in botPatterns gives itself
+func matchGenericBot(ua string) (string, bool) {
+	for _, re := range genericBots {
+		if m := re.FindStringSubmatch(ua); m != nil {
+			return m[1], true
+		}
+	}
+	return "", false
+}
+
+// matchFirst returns the name and version of the first pattern matching ua
+func matchFirst(patterns []pattern, ua string) (name, version string, ok bool) {
+	for _, p := range patterns {
+		m := p.re.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		for _, group := range m[1:] {
+			if group != "" {
+				version = group
+				break
+			}
+		}
+		return p.name, version, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,113 @@
+package useragent
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want Info
+	}{
+		{
+			"chrome on windows",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "120.0.0.0", OS: "Windows", OSVersion: "10", DeviceType: DeviceDesktop},
+		},
+		{
+			"edge before chrome",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			Info{Browser: "Edge", BrowserVersion: "120.0.2210.91", OS: "Windows", OSVersion: "10", DeviceType: DeviceDesktop},
+		},
+		{
+			"safari on iphone",
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Safari", BrowserVersion: "17.1", OS: "iOS", OSVersion: "17.1", DeviceType: DeviceMobile},
+		},
+		{
+			"safari on ipad",
+			"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1",
+			Info{Browser: "Safari", BrowserVersion: "16.6", OS: "iPadOS", OSVersion: "16.6", DeviceType: DeviceTablet},
+		},
+		{
+			"android tablet without mobile token",
+			"Mozilla/5.0 (Linux; Android 13; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "119.0.0.0", OS: "Android", OSVersion: "13", DeviceType: DeviceTablet},
+		},
+		{
+			"firefox on linux",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			Info{Browser: "Firefox", BrowserVersion: "121.0", OS: "Linux", DeviceType: DeviceDesktop},
+		},
+		{
+			"known bot",
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			Info{DeviceType: DeviceBot, BotName: "Googlebot"},
+		},
+		{
+			"generic crawler",
+			"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)",
+			Info{DeviceType: DeviceBot, BotName: "AhrefsBot"},
+		},
+		{
+			"crawler in a compatible comment",
+			"Mozilla/5.0 (Linux; Android 5.0) AppleWebKit/537.36 (KHTML, like Gecko) Mobile Safari/537.36 (compatible; Bytespider; spider-feedback@bytedance.com)",
+			Info{OS: "Android", OSVersion: "5.0", DeviceType: DeviceBot, BotName: "Bytespider"},
+		},
+		{
+			"device model containing bot",
+			"Mozilla/5.0 (Linux; Android 10; CUBOT_X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "120.0.6099.144", OS: "Android", OSVersion: "10", DeviceType: DeviceMobile},
+		},
+		{
+			"device model starting with robot",
+			"Mozilla/5.0 (Linux; Android 11; Robot-X Build/RP1A.200720.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Mobile Safari/537.36",
+			Info{Browser: "Chrome", BrowserVersion: "118.0.0.0", OS: "Android", OSVersion: "11", DeviceType: DeviceMobile},
+		},
+		{
+			"command line client",
+			"curl/8.4.0",
+			Info{DeviceType: DeviceBot, BotName: "curl"},
+		},
+		{
+			"empty",
+			"",
+			Info{DeviceType: DeviceBot, BotName: "Unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.ua); got != tt.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsBot(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want bool
+	}{
+		{"headless chrome", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0.0.0 Safari/537.36", true},
+		{"python", "python-requests/2.31.0", true},
+		{"uptime monitor", "Mozilla/5.0 (compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", true},
+		{"seo crawler", "Mozilla/5.0 (compatible; SemrushBot/7~bl; +http://www.semrush.com/bot.html)", true},
+		{"spider product token", "Screaming Frog SEO Spider/19.0", true},
+		{"crawler with a url after its name", "Mozilla/5.0 (compatible;PetalBot;+https://webmaster.petalsearch.com/site/petalbot)", true},
+		{"cubot phone", "Mozilla/5.0 (Linux; Android 10; CUBOT_X30) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36", false},
+		{"robot-x phone", "Mozilla/5.0 (Linux; Android 11; Robot-X Build/RP1A.200720.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Mobile Safari/537.36", false},
+		{"bot inside an app name", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Abbott_Connect/4.2", false},
+		{"whatsapp fetcher", "WhatsApp/2.23.20.0 A", true},
+		{"whatsapp in-app browser", "Mozilla/5.0 (Linux; Android 13; SM-S911B Build/TP1A.220624.014; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/119.0.6045.163 Mobile Safari/537.36 WhatsApp/2.23.24.76", false},
+		{"snapchat in-app browser", "Mozilla/5.0 (iPhone; CPU iPhone OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Snapchat/12.54.0.39 (like Safari/8615.3.12.11.2, panda)", false},
+		{"mobile chrome", "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsBot(tt.ua); got != tt.want {
+				t.Errorf("IsBot(%q) = %v, want %v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package useragent
+
+import "strings"
+
+// Platforms returned by DetectPlatform
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformOther   = "other"
+)
+
+// DetectPlatform returns the mobile platform a user agent runs on
+func DetectPlatform(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	// Android is checked first since some Android browsers also mention "like iPhone"
+	case strings.Contains(ua, "android"):
+		return PlatformAndroid
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		return PlatformIOS
+	}
+	return PlatformOther
+}
@@ -0,0 +1,55 @@
+package useragent
+
+import "strings"
+
+// unfurlerSignatures are lower-cased user-agent fragments of the crawlers that chat apps and
+// social networks use to build link previews. Apps whose in-app browsers also name the app, such as
+// WhatsApp, Viber and Snapchat, are matched by their preview fetcher only, so people tapping a link
+// in those apps are not mistaken for crawlers.
+var unfurlerSignatures = []string{
+	"facebookexternalhit",
+	"facebot",
+	"twitterbot",
+	"slackbot-linkexpanding",
+	"slack-imgproxy",
+	"linkedinbot",
+	"discordbot",
+	"telegrambot",
+	"skypeuripreview",
+	"microsoftpreview",
+	"pinterestbot",
+	"redditbot",
+	"applebot",
+	"mastodon",
+	"bluesky cardyb",
+	"vkshare",
+	"line-poker",
+	"snap url preview service",
+	"iframely",
+	"embedly",
+	"google-pagerenderer",
+	"bitlybot",
+}
+
+// unfurlerPrefixes are lower-cased user-agent prefixes of preview fetchers that share a fragment with
+// their app's in-app browser. WhatsApp fetches previews as "WhatsApp/2.23.20.0 A", while its in-app
+// browser has "WhatsApp/" after the usual Mozilla/5.0 user agent.
+var unfurlerPrefixes = []string{
+	"whatsapp/",
+}
+
+// IsUnfurler reports whether the user agent belongs to a known link-preview crawler
+func IsUnfurler(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, prefix := range unfurlerPrefixes {
+		if strings.HasPrefix(ua, prefix) {
+			return true
+		}
+	}
+	for _, signature := range unfurlerSignatures {
+		if strings.Contains(ua, signature) {
+			return true
+		}
+	}
+	return false
+}
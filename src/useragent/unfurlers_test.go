@@ -0,0 +1,33 @@
+package useragent
+
+import "testing"
+
+func TestIsUnfurler(t *testing.T) {
+	tests := []struct {
+		name string
+		ua   string
+		want bool
+	}{
+		{"facebook crawler", "facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"slack unfurler", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"discord", "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)", true},
+		{"telegram", "TelegramBot (like TwitterBot)", true},
+		{"whatsapp android fetcher", "WhatsApp/2.23.20.0 A", true},
+		{"whatsapp ios fetcher", "WhatsApp/2.23.18.78 i", true},
+		{"snapchat fetcher", "Snap URL Preview Service; bot; snapchat; https://developers.snap.com/robots", true},
+
+		{"whatsapp android in-app browser", "Mozilla/5.0 (Linux; Android 13; SM-S911B Build/TP1A.220624.014; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/119.0.6045.163 Mobile Safari/537.36 WhatsApp/2.23.24.76", false},
+		{"whatsapp ios in-app browser", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 WhatsApp/23.24.77", false},
+		{"viber in-app browser", "Mozilla/5.0 (Linux; Android 12; Pixel 6 Build/SQ3A.220705.004; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/115.0.5790.166 Mobile Safari/537.36 Viber/20.3.0.5", false},
+		{"snapchat in-app browser", "Mozilla/5.0 (iPhone; CPU iPhone OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 Snapchat/12.54.0.39 (like Safari/8615.3.12.11.2, panda)", false},
+		{"desktop chrome", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsUnfurler(tt.ua); got != tt.want {
+				t.Errorf("IsUnfurler(%q) = %v, want %v", tt.ua, got, tt.want)
+			}
+		})
+	}
+}
@@ -87,12 +87,16 @@ func formatValidationErrors(c *gin.Context, err error, inputType interface{}) []
 				errorMsg = "This field is required"
 			case "url":
 				errorMsg = "Must be a valid URL"
+			case "appurl":
+				errorMsg = "Must be an http, https or app URL"
 			case "alphanum":
 				errorMsg = "Must contain only alphanumeric characters"
 			case "min":
 				errorMsg = fmt.Sprintf("Must be at least %s characters long", e.Param())
 			case "max":
 				errorMsg = fmt.Sprintf("Must be at most %s characters long", e.Param())
+			case "oneof":
+				errorMsg = fmt.Sprintf("Must be one of: %s", strings.ReplaceAll(e.Param(), " ", ", "))
 			case "gt":
 				errorMsg = fmt.Sprintf("Must be greater than %s", e.Param())
 			case "omitempty":
@@ -0,0 +1,21 @@
+package validation
+
+import (
+	"errors"
+	"shurl/src/models"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// RegisterRules adds the application's own validation tags to gin's validator:
+//   - appurl: an http, https or custom app scheme URL, see models.IsAppURL
+func RegisterRules() error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected validator engine")
+	}
+	return v.RegisterValidation("appurl", func(fl validator.FieldLevel) bool {
+		return models.IsAppURL(fl.Field().String())
+	})
+}
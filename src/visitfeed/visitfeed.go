@@ -0,0 +1,491 @@
+package visitfeed
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"shurl/src/config"
+	"shurl/src/geoip"
+	"shurl/src/privacy"
+	"shurl/src/recorder"
+	"shurl/src/useragent"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// channel is the Postgres NOTIFY channel carrying visit events between replicas
+const channel = "visit_events"
+
+// maxPayload keeps notifications below the 8000 byte limit of NOTIFY payloads
+const maxPayload = 7500
+
+// maxFieldLength bounds the free-text fields of an event so that one always fits a notification
+const maxFieldLength = 255
+
+// Event is a visit as pushed to live streams. Fields the privacy options do not allow to keep are empty.
+type Event struct {
+	ID            int64     `json:"id"`
+	LinkID        int       `json:"link_id"`
+	Code          string    `json:"code"`
+	IPAddress     string    `json:"ip_address"`
+	IPMode        string    `json:"ip_mode"`
+	Anonymous     bool      `json:"anonymous"`
+	UserAgent     string    `json:"user_agent"`
+	Browser       string    `json:"browser"`
+	OS            string    `json:"os"`
+	DeviceType    string    `json:"device_type"`
+	BotName       string    `json:"bot_name"`
+	Country       string    `json:"country"`
+	City          string    `json:"city"`
+	Referrer      string    `json:"referrer"`
+	ReferrerHost  string    `json:"referrer_host"`
+	ReferrerClass string    `json:"referrer_class"`
+	Source        string    `json:"source"`
+	IsBot         bool      `json:"is_bot"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Options configures the hub
+type Options struct {
+	// QueueSize bounds the visits waiting to be published; visits beyond it are not streamed
+	QueueSize int
+	// BufferSize is how many recent events are kept for clients resuming with Last-Event-ID
+	BufferSize int
+	// SubscriberBuffer is how many events a slow client may fall behind before events are skipped for it
+	SubscriberBuffer int
+	// Heartbeat is how often idle streams send a comment to keep proxies from closing them
+	Heartbeat time.Duration
+	// Privacy decides what is streamed about visitors, as it decides what is stored
+	Privacy privacy.Options
+}
+
+// OptionsFromEnv reads the hub options from the environment
+func OptionsFromEnv() Options {
+	return Options{
+		QueueSize:        config.GetEnvInt("VISIT_STREAM_QUEUE_SIZE", 1000),
+		BufferSize:       config.GetEnvInt("VISIT_STREAM_BUFFER", 1000),
+		SubscriberBuffer: config.GetEnvInt("VISIT_STREAM_SUBSCRIBER_BUFFER", 64),
+		Heartbeat:        config.GetEnvDuration("VISIT_STREAM_HEARTBEAT", 15*time.Second),
+	}
+}
+
+// Stats is a snapshot of the hub counters
+type Stats struct {
+	Subscribers    int   `json:"subscribers"`
+	QueueDepth     int   `json:"queue_depth"`
+	Published      int64 `json:"published"`
+	Dropped        int64 `json:"dropped"`
+	Received       int64 `json:"received"`
+	Skipped        int64 `json:"skipped"`
+	NotifyFailures int64 `json:"notify_failures"`
+}
+
+// published is a visit waiting to be turned into an event
+type published struct {
+	code  string
+	visit recorder.Visit
+}
+
+// notification is the payload of a NOTIFY on channel
+type notification struct {
+	Instance string  `json:"instance"`
+	Events   []Event `json:"events"`
+}
+
+// Subscription receives the events of one link, or of all links
+type Subscription struct {
+	// C delivers events; it is closed when the hub shuts down
+	C <-chan Event
+
+	c           chan Event
+	linkID      *int
+	includeBots bool
+	hub         *Hub
+}
+
+// Hub fans visit events out to live stream subscribers. Visits published on one replica are delivered
+// to its own subscribers directly and to the other replicas through Postgres NOTIFY.
+type Hub struct {
+	db     *sql.DB
+	opts   Options
+	geo    *geoip.Enricher
+	logger *zap.Logger
+
+	// instance identifies this replica so it ignores its own notifications
+	instance string
+	queue    chan published
+
+	// mu guards the event ids, the replay buffer and the subscribers
+	mu     sync.Mutex
+	lastID int64
+	recent []Event
+	subs   map[*Subscription]struct{}
+	closed bool
+
+	listener *pq.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	published      atomic.Int64
+	dropped        atomic.Int64
+	received       atomic.Int64
+	skipped        atomic.Int64
+	notifyFailures atomic.Int64
+}
+
+// New creates a hub that locates visits with geo; call Start to begin publishing
+func New(db *sql.DB, opts Options, geo *geoip.Enricher) *Hub {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	if opts.BufferSize < 0 {
+		opts.BufferSize = 0
+	}
+	if opts.SubscriberBuffer < 1 {
+		opts.SubscriberBuffer = 1
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = 15 * time.Second
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Hub{
+		db:       db,
+		opts:     opts,
+		geo:      geo,
+		logger:   config.GetLogger(),
+		instance: hex.EncodeToString(id),
+		queue:    make(chan published, opts.QueueSize),
+		subs:     make(map[*Subscription]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Heartbeat is how often streams should send a keep-alive
+func (h *Hub) Heartbeat() time.Duration {
+	return h.opts.Heartbeat
+}
+
+// Start begins publishing queued visits and listening for the visits of other replicas
+func (h *Hub) Start() {
+	h.listener = pq.NewListener(os.Getenv("POSTGRES_URI"), time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				h.logger.Warn("visit stream listener event", zap.Int("event", int(event)), zap.Error(err))
+			}
+		})
+	if err := h.listener.Listen(channel); err != nil {
+		h.logger.Error("failed to listen for visit events", zap.Error(err))
+	}
+
+	h.wg.Add(2)
+	go h.publishLoop()
+	go h.listenLoop()
+	h.logger.Info("visit stream started", zap.String("instance", h.instance))
+}
+
+// Close stops publishing and ends every subscription
+func (h *Hub) Close() error {
+	close(h.done)
+	h.wg.Wait()
+
+	h.mu.Lock()
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+	h.mu.Unlock()
+
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Close()
+}
+
+// Publish queues a visit to code for streaming. It never blocks: when the queue is full the visit is
+// recorded but not streamed.
+func (h *Hub) Publish(code string, v recorder.Visit) {
+	select {
+	case h.queue <- published{code: code, visit: v}:
+	default:
+		h.dropped.Add(1)
+	}
+}
+
+// Subscribe registers a subscriber for the events of linkID, or of all links when linkID is nil.
+// Bot visits are only delivered when includeBots is set. When lastEventID is set, the buffered events
+// that arrived after it are returned so a reconnecting client can catch up. Resuming is best effort:
+// events older than the buffer are lost, and when this replica no longer holds lastEventID, as after
+// reconnecting to another replica, the buffered events with a higher id are returned, which may miss
+// events published around the same time by other replicas.
+func (h *Hub) Subscribe(linkID *int, includeBots bool, lastEventID int64) (*Subscription, []Event) {
+	c := make(chan Event, h.opts.SubscriberBuffer)
+	sub := &Subscription{C: c, c: c, linkID: linkID, includeBots: includeBots, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+		return sub, nil
+	}
+	h.subs[sub] = struct{}{}
+
+	var backlog []Event
+	if lastEventID > 0 {
+		// Events arrive from other replicas out of id order, so the buffer is replayed from the
+		// position of the last event the client saw when it is still there
+		start, found := 0, false
+		for i, ev := range h.recent {
+			if ev.ID == lastEventID {
+				start, found = i+1, true
+				break
+			}
+		}
+		for _, ev := range h.recent[start:] {
+			if (found || ev.ID > lastEventID) && sub.matches(ev) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	return sub, backlog
+}
+
+// Close unregisters the subscription
+func (s *Subscription) Close() {
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.c)
+	}
+}
+
+func (s *Subscription) matches(ev Event) bool {
+	return (s.linkID == nil || *s.linkID == ev.LinkID) && (s.includeBots || !ev.IsBot)
+}
+
+// Stats returns a snapshot of the hub counters
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	subscribers := len(h.subs)
+	h.mu.Unlock()
+	return Stats{
+		Subscribers:    subscribers,
+		QueueDepth:     len(h.queue),
+		Published:      h.published.Load(),
+		Dropped:        h.dropped.Load(),
+		Received:       h.received.Load(),
+		Skipped:        h.skipped.Load(),
+		NotifyFailures: h.notifyFailures.Load(),
+	}
+}
+
+// publishLoop turns queued visits into events, delivers them locally and notifies the other replicas,
+// sending whatever has queued up meanwhile in as few notifications as fit
+func (h *Hub) publishLoop() {
+	defer h.wg.Done()
+	for {
+		var p published
+		select {
+		case <-h.done:
+			return
+		case p = <-h.queue:
+		}
+
+		events := []Event{h.event(p)}
+	collect:
+		for len(events) < 100 {
+			select {
+			case p = <-h.queue:
+				events = append(events, h.event(p))
+			default:
+				break collect
+			}
+		}
+
+		h.assignIDs(events)
+		h.deliver(events)
+		h.published.Add(int64(len(events)))
+		h.notify(events)
+	}
+}
+
+// event enriches a visit and applies the privacy options to it
+func (h *Hub) event(p published) Event {
+	v := p.visit
+	ev := Event{
+		LinkID:    v.LinkID,
+		Code:      p.code,
+		Source:    v.Source,
+		IsBot:     v.IsBot,
+		CreatedAt: v.CreatedAt,
+	}
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now().UTC()
+	}
+
+	if v.DoNotTrack && h.opts.Privacy.HonorDoNotTrack {
+		ev.Anonymous = true
+		ev.IPMode = string(privacy.ModeNone)
+	} else {
+		ua := useragent.Parse(v.UserAgent)
+		loc := h.geo.Lookup(v.IPAddress)
+		ip, _ := h.opts.Privacy.Anonymize(v.IPAddress, privacy.ModeFull)
+
+		ev.IPAddress, ev.IPMode = ip, string(h.opts.Privacy.Mode)
+		ev.UserAgent = truncate(v.UserAgent)
+		ev.Browser, ev.OS, ev.DeviceType, ev.BotName = ua.Browser, ua.OS, ua.DeviceType, ua.BotName
+		ev.Country, ev.City = loc.Country, loc.City
+		ev.Referrer, ev.ReferrerHost, ev.ReferrerClass = truncate(v.Referrer), v.ReferrerHost, v.ReferrerClass
+	}
+	return ev
+}
+
+// assignIDs gives events ids from the visit_event_ids sequence, which every replica shares, so an id
+// names the same event everywhere. When the sequence cannot be read, ids continue locally from the
+// highest id seen.
+func (h *Hub) assignIDs(events []Event) {
+	ids, err := h.nextIDs(len(events))
+	if err != nil {
+		h.logger.Warn("failed to read visit event ids", zap.Error(err))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range events {
+		if i < len(ids) {
+			events[i].ID = ids[i]
+		} else {
+			events[i].ID = h.lastID + 1
+		}
+		h.lastID = max(h.lastID, events[i].ID)
+	}
+}
+
+// nextIDs reads n values from the visit_event_ids sequence, in increasing order
+func (h *Hub) nextIDs(n int) ([]int64, error) {
+	rows, err := h.db.Query("SELECT nextval('visit_event_ids') FROM generate_series(1, $1)", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, n)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// deliver buffers events for replay and hands them to the matching subscribers. A subscriber whose
+// buffer is full skips the event rather than holding up the others.
+func (h *Hub) deliver(events []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	for _, ev := range events {
+		// Ids of other replicas' events are taken into account so locally continued ids stay ahead of them
+		if ev.ID > h.lastID {
+			h.lastID = ev.ID
+		}
+		if h.opts.BufferSize > 0 {
+			if len(h.recent) >= h.opts.BufferSize {
+				h.recent = append(h.recent[:0], h.recent[1:]...)
+			}
+			h.recent = append(h.recent, ev)
+		}
+		for sub := range h.subs {
+			if !sub.matches(ev) {
+				continue
+			}
+			select {
+			case sub.c <- ev:
+			default:
+				h.skipped.Add(1)
+			}
+		}
+	}
+}
+
+// notify publishes events to the other replicas, split so that each payload fits a notification
+func (h *Hub) notify(events []Event) {
+	for len(events) > 0 {
+		n := len(events)
+		var payload []byte
+		for ; n > 0; n /= 2 {
+			var err error
+			payload, err = json.Marshal(notification{Instance: h.instance, Events: events[:n]})
+			if err != nil {
+				h.logger.Error("failed to encode visit events", zap.Error(err))
+				return
+			}
+			if len(payload) <= maxPayload || n == 1 {
+				break
+			}
+		}
+		events = events[n:]
+		if len(payload) > maxPayload {
+			h.notifyFailures.Add(1)
+			continue
+		}
+		if _, err := h.db.Exec("SELECT pg_notify($1, $2)", channel, string(payload)); err != nil {
+			h.notifyFailures.Add(1)
+			h.logger.Warn("failed to publish visit events", zap.Int("events", n), zap.Error(err))
+		}
+	}
+}
+
+// listenLoop delivers the events published by the other replicas
+func (h *Hub) listenLoop() {
+	defer h.wg.Done()
+	for {
+		select {
+		case <-h.done:
+			return
+		case n := <-h.listener.Notify:
+			// A nil notification means the connection was re-established; events sent meanwhile are lost
+			if n == nil {
+				continue
+			}
+			var msg notification
+			if err := json.Unmarshal([]byte(n.Extra), &msg); err != nil {
+				h.logger.Warn("invalid visit event notification", zap.Error(err))
+				continue
+			}
+			if msg.Instance == h.instance {
+				continue
+			}
+			h.received.Add(int64(len(msg.Events)))
+			h.deliver(msg.Events)
+		}
+	}
+}
+
+// truncate cuts s to maxFieldLength characters
+func truncate(s string) string {
+	runes := []rune(s)
+	if len(runes) <= maxFieldLength {
+		return s
+	}
+	return string(runes[:maxFieldLength])
+}
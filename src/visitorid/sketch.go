@@ -0,0 +1,95 @@
+package visitorid
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/axiomhq/hyperloglog"
+)
+
+// SketchKey identifies the visitors of one link on one UTC day
+type SketchKey struct {
+	LinkID int
+	Day    string
+}
+
+// UpdateSketches adds visitor identifiers to the HyperLogLog sketches stored per link and day in
+// visitor_sketches. Rows are locked in key order so concurrent writers cannot deadlock.
+func UpdateSketches(ctx context.Context, tx *sql.Tx, visitors map[SketchKey][]int64) error {
+	keys := make([]SketchKey, 0, len(visitors))
+	for key := range visitors {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].LinkID != keys[j].LinkID {
+			return keys[i].LinkID < keys[j].LinkID
+		}
+		return keys[i].Day < keys[j].Day
+	})
+
+	for _, key := range keys {
+		// The row is created first so that the select below always has a row to lock
+		if _, err := tx.ExecContext(ctx, `INSERT INTO visitor_sketches (link_id, day) VALUES ($1, $2)
+			ON CONFLICT (link_id, day) DO NOTHING`, key.LinkID, key.Day); err != nil {
+			return err
+		}
+		var data []byte
+		if err := tx.QueryRowContext(ctx, `SELECT sketch FROM visitor_sketches WHERE link_id = $1 AND day = $2 FOR UPDATE`,
+			key.LinkID, key.Day).Scan(&data); err != nil {
+			return err
+		}
+
+		sketch, err := decodeSketch(data)
+		if err != nil {
+			return err
+		}
+		for _, id := range visitors[key] {
+			sketch.InsertHash(uint64(id))
+		}
+		if data, err = sketch.MarshalBinary(); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE visitor_sketches SET sketch = $3 WHERE link_id = $1 AND day = $2`,
+			key.LinkID, key.Day, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Estimator merges stored sketches into an approximate count of distinct visitors
+type Estimator struct {
+	sketch *hyperloglog.Sketch
+}
+
+// NewEstimator creates an empty estimator
+func NewEstimator() *Estimator {
+	return &Estimator{sketch: hyperloglog.New()}
+}
+
+// Add merges a stored sketch into the estimate
+func (e *Estimator) Add(data []byte) error {
+	sketch, err := decodeSketch(data)
+	if err != nil {
+		return err
+	}
+	return e.sketch.Merge(sketch)
+}
+
+// Estimate returns the approximate number of distinct visitors added so far
+func (e *Estimator) Estimate() int {
+	return int(e.sketch.Estimate())
+}
+
+// decodeSketch reads a stored sketch; a null sketch is empty
+func decodeSketch(data []byte) (*hyperloglog.Sketch, error) {
+	sketch := hyperloglog.New()
+	if len(data) == 0 {
+		return sketch, nil
+	}
+	if err := sketch.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return sketch, nil
+}
@@ -0,0 +1,98 @@
+package visitorid
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// saltRetention is how many days of salts are kept. Yesterday's salt stays available for visits
+// queued just before midnight; older salts are deleted so old hashes can no longer be recomputed.
+const saltRetention = 2
+
+// Hasher derives anonymous visitor identifiers. A visitor is the hash of a secret salt, the link,
+// the IP address and the user agent. The salt changes every UTC day and is shared between replicas
+// through the visitor_salts table, so the same person is one visitor per link per day, cannot be
+// followed across days or links, and the hash cannot be reversed once the salt is deleted.
+type Hasher struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	salts map[string][]byte
+}
+
+// New creates a hasher storing its salts in db
+func New(db *sql.DB) *Hasher {
+	return &Hasher{db: db, salts: make(map[string][]byte)}
+}
+
+// Hash returns the visitor identifier of a visit to linkID made at t
+func (h *Hasher) Hash(ctx context.Context, linkID int, ip, userAgent string, t time.Time) (int64, error) {
+	salt, err := h.salt(ctx, Day(t))
+	if err != nil {
+		return 0, err
+	}
+
+	mac := sha256.New()
+	mac.Write(salt)
+	mac.Write([]byte(strconv.Itoa(linkID)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(ip))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userAgent))
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil))), nil
+}
+
+// Day is the UTC calendar day of t, which selects the salt
+func Day(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// salt returns the salt of day, creating it if no replica has yet
+func (h *Hasher) salt(ctx context.Context, day string) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if salt, ok := h.salts[day]; ok {
+		return salt, nil
+	}
+
+	candidate := make([]byte, 32)
+	if _, err := rand.Read(candidate); err != nil {
+		return nil, err
+	}
+	// When another replica creates the salt concurrently the insert does nothing and the
+	// select may not see the new row yet, so the salt is read again
+	var salt []byte
+	err := h.db.QueryRowContext(ctx, `WITH inserted AS (
+			INSERT INTO visitor_salts (day, salt) VALUES ($1, $2)
+			ON CONFLICT (day) DO NOTHING
+			RETURNING salt
+		)
+		SELECT salt FROM inserted
+		UNION ALL
+		SELECT salt FROM visitor_salts WHERE day = $1
+		LIMIT 1`, day, candidate).Scan(&salt)
+	if err == sql.ErrNoRows {
+		err = h.db.QueryRowContext(ctx, `SELECT salt FROM visitor_salts WHERE day = $1`, day).Scan(&salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A new day also retires the salts that are no longer needed
+	if _, err := h.db.ExecContext(ctx, `DELETE FROM visitor_salts WHERE day < $1::date - $2::int`, day, saltRetention-1); err != nil {
+		return nil, err
+	}
+	for cached := range h.salts {
+		if cached < day {
+			delete(h.salts, cached)
+		}
+	}
+	h.salts[day] = salt
+	return salt, nil
+}